@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"errors"
+	"sync"
+)
+
+// Acker tracks the acknowledgement of a single event and of every event
+// derived from it. A source creates the root with NewAcker, each stage
+// derives one child per emitted event and then resolves its own input with
+// Ack or Nack. The root callbacks fire once, after every derived event has
+// been resolved: onAck when all of them succeeded, onNack with the first
+// failure otherwise.
+//
+// All methods are safe to call on a nil *Acker, which makes them no-ops.
+type Acker struct {
+	mu       sync.Mutex
+	parent   *Acker
+	pending  int
+	sealed   bool
+	resolved bool
+	err      error
+	leaves   int
+	// split is set once a derives a child, a leaf never does.
+	split  bool
+	onAck  func()
+	onNack func(error)
+}
+
+func NewAcker(onAck func(), onNack func(error)) *Acker {
+	return &Acker{
+		onAck:  onAck,
+		onNack: onNack,
+	}
+}
+
+// Derive returns a child whose resolution is required before a can resolve.
+// It must be called before a is acked or nacked.
+func (a *Acker) Derive() *Acker {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sealed {
+		panic("acker: derive after ack")
+	}
+	a.pending++
+	a.split = true
+
+	return &Acker{
+		parent: a,
+	}
+}
+
+// Ack marks the work of a as successful. a resolves once all derived
+// children are resolved as well.
+func (a *Acker) Ack() {
+	a.seal(nil)
+}
+
+// Nack marks the work of a as failed. a resolves as failed once all derived
+// children are resolved.
+func (a *Acker) Nack(err error) {
+	if err == nil {
+		err = errors.New("acker: nacked")
+	}
+	a.seal(err)
+}
+
+func (a *Acker) seal(err error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if a.sealed {
+		a.mu.Unlock()
+		return
+	}
+	a.sealed = true
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+
+	a.tryResolve()
+}
+
+// splitInto marks a as split into the events derived from it, such as a file
+// into its rows, before any is. A file without rows then counts no leaf
+// instead of one.
+func (a *Acker) splitInto() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.split = true
+}
+
+// Leaves returns the number of events at the bottom of the tree below a,
+// the rows of a file for instance. It is final once a is resolved.
+func (a *Acker) Leaves() int {
+	if a == nil {
+		return 0
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.leaves
+}
+
+func (a *Acker) childResolved(err error, leaves int) {
+	a.mu.Lock()
+	a.pending--
+	a.leaves += leaves
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+
+	a.tryResolve()
+}
+
+func (a *Acker) tryResolve() {
+	a.mu.Lock()
+	if a.resolved || !a.sealed || a.pending > 0 {
+		a.mu.Unlock()
+		return
+	}
+	a.resolved = true
+	err := a.err
+	leaves := a.leaves
+	if !a.split {
+		leaves = 1
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		if a.onNack != nil {
+			a.onNack(err)
+		}
+	} else if a.onAck != nil {
+		a.onAck()
+	}
+
+	if a.parent != nil {
+		a.parent.childResolved(err, leaves)
+	}
+}
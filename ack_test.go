@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcker(t *testing.T) {
+
+	cases := []struct {
+		children   int
+		nackChild  int
+		expectAck  bool
+		expectNack bool
+	}{
+		{
+			children:  0,
+			nackChild: -1,
+			expectAck: true,
+		},
+		{
+			children:  3,
+			nackChild: -1,
+			expectAck: true,
+		},
+		{
+			children:   3,
+			nackChild:  1,
+			expectNack: true,
+		},
+	}
+
+	for i, c := range cases {
+		acked, nacked := 0, 0
+		root := NewAcker(func() { acked++ }, func(error) { nacked++ })
+
+		var children []*Acker
+		for j := 0; j < c.children; j++ {
+			children = append(children, root.Derive())
+		}
+		root.Ack()
+
+		for j, child := range children {
+			if acked+nacked != 0 {
+				t.Fatalf("case (%d) root resolved before child %d", i, j)
+			}
+			if j == c.nackChild {
+				child.Nack(fmt.Errorf("failed"))
+			} else {
+				child.Ack()
+			}
+		}
+
+		if c.expectAck && acked != 1 {
+			t.Fatalf("case (%d) expected one ack got %d", i, acked)
+		}
+		if c.expectNack && nacked != 1 {
+			t.Fatalf("case (%d) expected one nack got %d", i, nacked)
+		}
+		if acked+nacked != 1 {
+			t.Fatalf("case (%d) expected the root to resolve once got %d", i, acked+nacked)
+		}
+	}
+
+}
+
+func TestAckerNil(t *testing.T) {
+	var a *Acker
+
+	if a.Derive() != nil {
+		t.Fatalf("expected nil child")
+	}
+	a.Ack()
+	a.Nack(fmt.Errorf("failed"))
+}
+
+func TestAckerLeaves(t *testing.T) {
+
+	root := NewAcker(nil, nil)
+
+	// a file split into no row, one split into two rows and an event
+	// which is never split, a leaf itself
+	empty := root.Derive()
+	empty.splitInto()
+	rows := root.Derive()
+	row1, row2 := rows.Derive(), rows.Derive()
+	leaf := root.Derive()
+	root.Ack()
+
+	empty.Ack()
+	rows.Ack()
+	row1.Ack()
+	row2.Ack()
+	leaf.Ack()
+
+	if rows.Leaves() != 2 {
+		t.Fatalf("expected 2 leaves got %d", rows.Leaves())
+	}
+	if root.Leaves() != 3 {
+		t.Fatalf("expected 3 leaves got %d", root.Leaves())
+	}
+}
+
+func TestProcessCSVAck(t *testing.T) {
+
+	acked := make(chan struct{})
+	root := NewAcker(func() { close(acked) }, nil)
+
+	csvProcessor := csvProcessor{
+		sep: ',',
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fileInfoCh := make(chan FileInfo, 1)
+	fileInfoCh <- &S3File{
+		f:        io.NopCloser(strings.NewReader("a,b\n1,2\n3,4\n")),
+		fileName: "test.csv",
+		ack:      root.Derive(),
+	}
+	root.Ack()
+	close(fileInfoCh)
+
+	var rows []FileRow
+	for row := range csvProcessor.ProcessCSV(ctx, fileInfoCh) {
+		rows = append(rows, row)
+	}
+
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows got %d", len(rows))
+	}
+
+	for _, row := range rows {
+		select {
+		case <-acked:
+			t.Fatalf("acked before every row was acked")
+		default:
+		}
+		row.GetAck().Ack()
+	}
+
+	select {
+	case <-acked:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+	if root.Leaves() != 2 {
+		t.Fatalf("expected 2 leaves got %d", root.Leaves())
+	}
+}
@@ -0,0 +1,257 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// avroSchema is a record of primitive fields, optionally nullable, which is
+// the part of Avro the rows of a CSV file need.
+type avroSchema struct {
+	name   string
+	fields []avroField
+	// text is the schema as registered.
+	text string
+}
+
+type avroField struct {
+	name string
+	// column is the column of the row the field holds.
+	column   string
+	typ      string
+	nullable bool
+	// nullIndex is the branch of null in the union of a nullable field.
+	nullIndex int
+}
+
+var avroPrimitives = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"int":     true,
+	"long":    true,
+	"float":   true,
+	"double":  true,
+	"bytes":   true,
+	"string":  true,
+}
+
+// parseAvroSchema parses a record schema whose fields are primitives or
+// unions of null and a primitive. The fields hold the columns of the same
+// name.
+func parseAvroSchema(text string) (*avroSchema, error) {
+
+	var record struct {
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(text), &record); err != nil {
+		return nil, fmt.Errorf("avro: invalid schema %w", err)
+	}
+	if record.Type != "record" {
+		return nil, fmt.Errorf("avro: expecting a record schema got %q", record.Type)
+	}
+
+	schema := &avroSchema{name: record.Name, text: text}
+	for _, f := range record.Fields {
+		field, err := parseAvroField(f.Name, f.Type)
+		if err != nil {
+			return nil, err
+		}
+		schema.fields = append(schema.fields, field)
+	}
+
+	return schema, nil
+}
+
+func parseAvroField(name string, raw json.RawMessage) (avroField, error) {
+
+	field := avroField{name: name, column: name}
+
+	var typ string
+	if err := json.Unmarshal(raw, &typ); err == nil {
+		if !avroPrimitives[typ] {
+			return field, fmt.Errorf("avro: unsupported type %v of field %v", typ, name)
+		}
+		field.typ = typ
+		return field, nil
+	}
+
+	var union []string
+	if err := json.Unmarshal(raw, &union); err != nil || len(union) != 2 {
+		return field, fmt.Errorf("avro: unsupported type %s of field %v", raw, name)
+	}
+	for i, typ := range union {
+		if typ == "null" {
+			field.nullable = true
+			field.nullIndex = i
+			continue
+		}
+		if !avroPrimitives[typ] {
+			return field, fmt.Errorf("avro: unsupported type %v of field %v", typ, name)
+		}
+		field.typ = typ
+	}
+	if !field.nullable || field.typ == "" {
+		return field, fmt.Errorf("avro: unsupported type %s of field %v", raw, name)
+	}
+
+	return field, nil
+}
+
+// deriveAvroSchema returns a record of nullable strings, one per column,
+// in the order of the column names.
+func deriveAvroSchema(name, namespace string, columns []string) (*avroSchema, error) {
+
+	sorted := append([]string(nil), columns...)
+	sort.Strings(sorted)
+
+	type fieldJSON struct {
+		Name    string      `json:"name"`
+		Type    []string    `json:"type"`
+		Default interface{} `json:"default"`
+	}
+	record := struct {
+		Type      string      `json:"type"`
+		Name      string      `json:"name"`
+		Namespace string      `json:"namespace,omitempty"`
+		Fields    []fieldJSON `json:"fields"`
+	}{
+		Type:      "record",
+		Name:      avroName(name),
+		Namespace: namespace,
+		Fields:    make([]fieldJSON, 0, len(sorted)),
+	}
+
+	schema := &avroSchema{name: record.Name}
+	names := make(map[string]string)
+	for _, column := range sorted {
+		fieldName := avroName(column)
+		if other, exist := names[fieldName]; exist {
+			return nil, fmt.Errorf("avro: columns %v and %v are both named %v", other, column, fieldName)
+		}
+		names[fieldName] = column
+
+		record.Fields = append(record.Fields, fieldJSON{
+			Name: fieldName,
+			Type: []string{"null", "string"},
+		})
+		schema.fields = append(schema.fields, avroField{
+			name:     fieldName,
+			column:   column,
+			typ:      "string",
+			nullable: true,
+		})
+	}
+
+	text, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("avro: %w", err)
+	}
+	schema.text = string(text)
+
+	return schema, nil
+}
+
+// avroName replaces the characters an Avro name can not hold by _.
+func avroName(s string) string {
+	name := []byte(s)
+	for i, c := range name {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return "_"
+	}
+	return string(name)
+}
+
+// encode appends the Avro binary encoding of row to buf. A missing column,
+// or an empty one of a nullable field other than a string, is null.
+func (schema *avroSchema) encode(buf []byte, row map[string]string) ([]byte, error) {
+
+	for _, field := range schema.fields {
+		value, exist := row[field.column]
+		isNull := !exist || (value == "" && field.typ != "string" && field.typ != "bytes")
+
+		if field.nullable {
+			if isNull {
+				buf = appendAvroLong(buf, int64(field.nullIndex))
+				continue
+			}
+			buf = appendAvroLong(buf, int64(1-field.nullIndex))
+		} else if !exist && field.typ != "null" {
+			return nil, fmt.Errorf("avro: the row has no %v column", field.column)
+		}
+
+		var err error
+		if buf, err = appendAvroValue(buf, field.typ, value); err != nil {
+			return nil, fmt.Errorf("avro: invalid %v value of column %v %w", field.typ, field.column, err)
+		}
+	}
+
+	return buf, nil
+}
+
+func appendAvroValue(buf []byte, typ, value string) ([]byte, error) {
+
+	switch typ {
+	case "null":
+		return buf, nil
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case "int", "long":
+		bits := 64
+		if typ == "int" {
+			bits = 32
+		}
+		n, err := strconv.ParseInt(value, 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		return appendAvroLong(buf, n), nil
+	case "float":
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, err
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(f)))
+		return append(buf, b[:]...), nil
+	case "double":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+		return append(buf, b[:]...), nil
+	}
+
+	// string and bytes
+	buf = appendAvroLong(buf, int64(len(value)))
+	return append(buf, value...), nil
+}
+
+// appendAvroLong appends n zig-zag encoded as a variable length integer,
+// which is the encoding of binary.PutVarint.
+func appendAvroLong(buf []byte, n int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], n)]...)
+}
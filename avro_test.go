@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAvroEncode(t *testing.T) {
+
+	schema, err := parseAvroSchema(`{
+		"type": "record",
+		"name": "order",
+		"fields": [
+			{"name": "id", "type": "long"},
+			{"name": "name", "type": "string"},
+			{"name": "paid", "type": "boolean"},
+			{"name": "amount", "type": ["null", "double"]},
+			{"name": "count", "type": ["int", "null"]},
+			{"name": "ratio", "type": "float"}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	cases := []struct {
+		row       map[string]string
+		expect    []byte
+		expectErr bool
+	}{
+		{
+			row: map[string]string{"id": "-3", "name": "ab", "paid": "true", "amount": "1.5", "count": "64", "ratio": "0.5"},
+			expect: []byte{
+				0x05,           // id -3 zig-zag
+				0x04, 'a', 'b', // name
+				0x01,                               // paid
+				0x02, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, // amount, branch 1 then 1.5
+				0x00, 0x80, 0x01, // count, branch 0 then 64
+				0, 0, 0, 0x3f, // ratio 0.5
+			},
+		},
+		{
+			// empty and missing nullable columns are null
+			row: map[string]string{"id": "1", "name": "", "paid": "false", "amount": "", "ratio": "0"},
+			expect: []byte{
+				0x02,
+				0x00,
+				0x00,
+				0x00,
+				0x02,
+				0, 0, 0, 0,
+			},
+		},
+		{
+			row:       map[string]string{"id": "x", "name": "", "paid": "false", "ratio": "0"},
+			expectErr: true,
+		},
+		{
+			row:       map[string]string{"id": "1", "name": "", "paid": "false", "count": "4294967296", "ratio": "0"},
+			expectErr: true,
+		},
+		{
+			row:       map[string]string{"id": "1", "paid": "false", "ratio": "0"},
+			expectErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		got, err := schema.encode(nil, c.row)
+		if c.expectErr {
+			if err == nil {
+				t.Fatalf("case (%d) expecting an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		if !bytes.Equal(got, c.expect) {
+			t.Fatalf("case (%d) expecting % x got % x", i, c.expect, got)
+		}
+	}
+}
+
+func TestParseAvroSchema(t *testing.T) {
+
+	invalid := []string{
+		`not json`,
+		`"string"`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": "fixed"}]}`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": ["string", "long"]}]}`,
+		`{"type": "record", "name": "r", "fields": [{"name": "a", "type": {"type": "array", "items": "string"}}]}`,
+	}
+	for i, text := range invalid {
+		if _, err := parseAvroSchema(text); err == nil {
+			t.Fatalf("case (%d) expecting an error", i)
+		}
+	}
+}
+
+func TestDeriveAvroSchema(t *testing.T) {
+
+	schema, err := deriveAvroSchema("orders.v1", "com.example", []string{"name", "1st col", "id"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(schema.text), &record); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expect := map[string]interface{}{
+		"type":      "record",
+		"name":      "orders_v1",
+		"namespace": "com.example",
+		"fields": []interface{}{
+			map[string]interface{}{"name": "_st_col", "type": []interface{}{"null", "string"}, "default": nil},
+			map[string]interface{}{"name": "id", "type": []interface{}{"null", "string"}, "default": nil},
+			map[string]interface{}{"name": "name", "type": []interface{}{"null", "string"}, "default": nil},
+		},
+	}
+	if !reflect.DeepEqual(record, expect) {
+		t.Fatalf("expecting %v got %v", expect, record)
+	}
+
+	// the derived schema parses back to the same fields, by name
+	parsed, err := parseAvroSchema(schema.text)
+	if err != nil || len(parsed.fields) != 3 || parsed.fields[0].name != "_st_col" || !parsed.fields[0].nullable {
+		t.Fatalf("unexpected parsed schema %+v %v", parsed, err)
+	}
+
+	if _, err := deriveAvroSchema("t", "", []string{"a b", "a-b"}); err == nil {
+		t.Fatalf("expecting an error for columns with the same field name")
+	}
+}
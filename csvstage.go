@@ -14,8 +14,26 @@ func NewCSVProcessor(sep rune) *csvProcessor {
 	}
 }
 
+// CSVConfig configures the CSV processor.
+type CSVConfig struct {
+	Separator rune
+	// OmitFileLine leaves the rows as they are in the file, without the
+	// file and line columns. Their provenance is still available from the
+	// FileRow, e.g. to the kafka stage headers.
+	OmitFileLine bool
+}
+
+func NewCSVProcessorWithConfig(cnf CSVConfig) *csvProcessor {
+
+	return &csvProcessor{
+		sep:          cnf.Separator,
+		omitFileLine: cnf.OmitFileLine,
+	}
+}
+
 type csvProcessor struct {
-	sep rune
+	sep          rune
+	omitFileLine bool
 }
 
 func (cp *csvProcessor) ProcessCSV(ctx context.Context, fileEventCh chan FileInfo) chan FileRow {
@@ -56,70 +74,86 @@ func (cp *csvProcessor) ProcessCSV(ctx context.Context, fileEventCh chan FileInf
 				// 	}
 				// }
 
-				reader := csv.NewReader(fileInfo.File())
-				reader.Comma = cp.sep
+				fileInfo.GetAck().splitInto()
+				err := cp.parseFile(fileInfo, sendResult)
+				fileInfo.File().Close()
 
-				header, err := reader.Read()
 				if err != nil {
-					if err != io.EOF {
-						sendResult(&csvRow{
-							err: wrapError(fmt.Errorf("parseCSV: failed to read %v file header %w", fileInfo.FileName(), err)),
-						})
-					}
-					break
+					sendResult(&csvRow{
+						err: err,
+					})
+					fileInfo.GetAck().Nack(err)
+				} else {
+					fileInfo.GetAck().Ack()
 				}
 
-				lineCounter := 0
+			}
+		}
 
-				for {
+	}()
 
-					line, err := reader.Read()
-					lineCounter++
-					if err != nil {
-						if err != io.EOF {
-							sendResult(&csvRow{
-								err: wrapError(fmt.Errorf("parseCSV: failed to read %v file row %w", fileInfo.FileName(), err)),
-							})
-						}
-						break
-					}
+	return resultCh
+}
 
-					row := make(map[string]string)
-					for i, header := range header {
-						row[header] = line[i]
-					}
-					row["file"] = fileInfo.FileName()
-					row["line"] = fmt.Sprint(lineCounter)
+// parseFile sends one row per line of the file, it returns the error that
+// stopped the parsing.
+func (cp *csvProcessor) parseFile(fileInfo FileInfo, sendResult func(*csvRow)) error {
 
-					sendResult(&csvRow{
-						data:     row,
-						fileName: fileInfo.FileName(),
-					})
+	reader := csv.NewReader(fileInfo.File())
+	reader.Comma = cp.sep
 
-				}
+	header, err := reader.Read()
+	if err != nil {
+		if err != io.EOF {
+			return wrapError(fmt.Errorf("parseCSV: failed to read %v file header %w", fileInfo.FileName(), err))
+		}
+		return nil
+	}
 
-				if fileInfo.GetOnDone() != nil {
-					f := *fileInfo.GetOnDone()
-					f()
-				}
+	lineCounter := 0
+
+	for {
 
+		line, err := reader.Read()
+		lineCounter++
+		if err != nil {
+			if err != io.EOF {
+				return wrapError(fmt.Errorf("parseCSV: failed to read %v file row %w", fileInfo.FileName(), err))
 			}
+			return nil
 		}
 
-	}()
+		row := make(map[string]string)
+		for i, header := range header {
+			row[header] = line[i]
+		}
+		if !cp.omitFileLine {
+			row["file"] = fileInfo.FileName()
+			row["line"] = fmt.Sprint(lineCounter)
+		}
 
-	return resultCh
+		sendResult(&csvRow{
+			data:     row,
+			fileName: fileInfo.FileName(),
+			line:     lineCounter,
+			meta:     fileInfo.Meta(),
+			ack:      fileInfo.GetAck().Derive(),
+		})
+
+	}
 }
 
 type csvRow struct {
 	err      error
 	fileName string
+	line     int
 	data     interface{}
-	done     *func()
+	meta     ObjectMeta
+	ack      *Acker
 }
 
-func (ki *csvRow) GetOnDone() *func() {
-	return ki.done
+func (ki *csvRow) GetAck() *Acker {
+	return ki.ack
 }
 
 func (ki *csvRow) Data() interface{} {
@@ -133,3 +167,12 @@ func (ki *csvRow) GetError() error {
 func (e *csvRow) FileName() string {
 	return e.fileName
 }
+
+// Line returns the line of the row in its file, the header excluded.
+func (e *csvRow) Line() int {
+	return e.line
+}
+
+func (e *csvRow) Meta() ObjectMeta {
+	return e.meta
+}
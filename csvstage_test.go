@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"context"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
@@ -11,14 +12,15 @@ import (
 func TestProcessCSV(t *testing.T) {
 
 	cases := []struct {
-		fileInfo   FileInfo
-		csvContent string
-		sep        rune
-		expect     FileRow
+		fileInfo     FileInfo
+		csvContent   string
+		sep          rune
+		omitFileLine bool
+		expect       FileRow
 	}{
 		{
 			fileInfo: &S3File{
-				f:        strings.NewReader("name;family;age\npayam;yousefi;38\n"),
+				f:        io.NopCloser(strings.NewReader("name;family;age\npayam;yousefi;38\n")),
 				fileName: "test.csv",
 			},
 			sep: rune(';'),
@@ -31,14 +33,32 @@ func TestProcessCSV(t *testing.T) {
 					"file":   "test.csv",
 				},
 				fileName: "test.csv",
+				line:     1,
+			},
+		},
+		{
+			fileInfo: &S3File{
+				f:        io.NopCloser(strings.NewReader("name,age\npayam,38\n")),
+				fileName: "test.csv",
+			},
+			sep:          rune(','),
+			omitFileLine: true,
+			expect: &csvRow{
+				data: map[string]string{
+					"name": "payam",
+					"age":  "38",
+				},
+				fileName: "test.csv",
+				line:     1,
 			},
 		},
 	}
 
 	for i, c := range cases {
-		csvProcessor := csvProcessor{
-			sep: c.sep,
-		}
+		csvProcessor := NewCSVProcessorWithConfig(CSVConfig{
+			Separator:    c.sep,
+			OmitFileLine: c.omitFileLine,
+		})
 		ctx, cancel := context.WithCancel(context.Background())
 
 		fileInfoCh := make(chan FileInfo)
@@ -0,0 +1,333 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type fileFormat int
+
+const (
+	formatPlain fileFormat = iota
+	formatGzip
+	formatBzip2
+	formatZstd
+	formatZip
+	formatTar
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic   = []byte("PK\x03\x04")
+)
+
+// detectFormat looks at the leading bytes of a file first and falls back to
+// its extension, which is needed for tar files without the ustar header.
+func detectFormat(name string, head []byte) fileFormat {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return formatGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return formatZstd
+	case bytes.HasPrefix(head, bzip2Magic):
+		return formatBzip2
+	case bytes.HasPrefix(head, zipMagic):
+		return formatZip
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar
+	}
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz", ".tgz":
+		return formatGzip
+	case ".zst":
+		return formatZstd
+	case ".bz2":
+		return formatBzip2
+	case ".zip":
+		return formatZip
+	case ".tar":
+		return formatTar
+	}
+
+	return formatPlain
+}
+
+// decompressedName drops the compression extension, "a.tar.gz" becomes
+// "a.tar" and "a.tgz" becomes "a.tar".
+func decompressedName(name string) string {
+	ext := path.Ext(name)
+	switch strings.ToLower(ext) {
+	case ".gz", ".zst", ".bz2":
+		return strings.TrimSuffix(name, ext)
+	case ".tgz":
+		return strings.TrimSuffix(name, ext) + ".tar"
+	}
+	return name
+}
+
+// readCloser pairs a reader with the function releasing what it reads from.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.close()
+}
+
+// expand sends file to sendResult with its content decompressed, or one
+// file per entry when it is an archive. expand owns file.f: it either hands
+// it over with the sent file or closes it once the archive is consumed.
+//
+// Archive entries are sent one at a time, the next one once the consumer
+// closed the previous, and the archive is acked after every entry is.
+func (stg s3Stage) expand(ctx context.Context, file *S3File, sendResult func(*S3File)) {
+
+	if file.GetError() != nil {
+		sendResult(file)
+		return
+	}
+
+	fail := func(err error) {
+		file.f.Close()
+		sendResult(&S3File{
+			err: err,
+		})
+		file.ack.Nack(err)
+	}
+
+	br := bufio.NewReader(file.f)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		fail(wrapError(fmt.Errorf("expand: failed to read %v %w", file.fileName, err)))
+		return
+	}
+
+	var dec io.Reader
+	var decClose func()
+	switch detectFormat(file.fileName, head) {
+	case formatGzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			fail(wrapError(fmt.Errorf("expand: invalid gzip file %v %w", file.fileName, err)))
+			return
+		}
+		dec, decClose = gz, func() { gz.Close() }
+	case formatBzip2:
+		dec = bzip2.NewReader(br)
+	case formatZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			fail(wrapError(fmt.Errorf("expand: invalid zstd file %v %w", file.fileName, err)))
+			return
+		}
+		dec, decClose = zr, zr.Close
+	case formatZip:
+		stg.expandZip(ctx, file, br, sendResult)
+		return
+	case formatTar:
+		stg.expandTar(ctx, file, br, sendResult)
+		return
+	default:
+		file.f = &readCloser{Reader: br, close: file.f.Close}
+		sendResult(file)
+		return
+	}
+
+	src := file.f
+	decompressed := *file
+	decompressed.fileName = decompressedName(file.fileName)
+	if spilled, ok := src.(*spillFile); ok {
+		decompressed.source = spilled
+	}
+	decompressed.f = &readCloser{
+		Reader: dec,
+		close: func() error {
+			if decClose != nil {
+				decClose()
+			}
+			return src.Close()
+		},
+	}
+
+	// a compressed archive, e.g. tar.gz, is expanded as well
+	stg.expand(ctx, &decompressed, sendResult)
+}
+
+func (stg s3Stage) expandTar(ctx context.Context, file *S3File, r io.Reader, sendResult func(*S3File)) {
+
+	defer file.f.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = wrapError(fmt.Errorf("expand: failed to read tar archive %v %w", file.fileName, err))
+			sendResult(&S3File{
+				err: err,
+			})
+			file.ack.Nack(err)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if !stg.sendEntry(ctx, file, hdr.Name, io.NopCloser(tr), sendResult) {
+			return
+		}
+	}
+
+	file.ack.Ack()
+}
+
+func (stg s3Stage) expandZip(ctx context.Context, file *S3File, r io.Reader, sendResult func(*S3File)) {
+
+	defer file.f.Close()
+
+	// zip needs random access, a streamed archive is spilled to disk first
+	ra, ok := file.f.(*spillFile)
+	if !ok {
+		spilled, err := stg.spillArchive(ctx, file, r)
+		if spilled != nil {
+			defer spilled.Close()
+		}
+		if err != nil {
+			err = wrapError(fmt.Errorf("expand: failed to spill zip archive %v %w", file.fileName, err))
+			sendResult(&S3File{
+				err: err,
+			})
+			file.ack.Nack(err)
+			return
+		}
+		ra = spilled
+	}
+
+	zr, err := zipReader(ra.File)
+	if err != nil {
+		err = wrapError(fmt.Errorf("expand: invalid zip archive %v %w", file.fileName, err))
+		sendResult(&S3File{
+			err: err,
+		})
+		file.ack.Nack(err)
+		return
+	}
+
+	for _, entry := range zr.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := entry.Open()
+		if err != nil {
+			err = wrapError(fmt.Errorf("expand: failed to open %v in zip archive %v %w", entry.Name, file.fileName, err))
+			sendResult(&S3File{
+				err: err,
+			})
+			file.ack.Nack(err)
+			return
+		}
+
+		if !stg.sendEntry(ctx, file, entry.Name, rc, sendResult) {
+			return
+		}
+	}
+
+	file.ack.Ack()
+}
+
+// spillArchive copies r to a spill file charged to the disk budget. The
+// object size is acquired up front and the bytes written beyond it, when
+// the archive was compressed, are charged once written. A compressed archive
+// downloaded to a spill file already holds the object size, only the bytes
+// beyond it are charged then. The returned file is to be closed even with an
+// error.
+func (stg s3Stage) spillArchive(ctx context.Context, file *S3File, r io.Reader) (*spillFile, error) {
+
+	var held int64
+	if file.source != nil && file.source.budget != nil {
+		held = file.source.size
+	}
+
+	size := file.meta.Size - held
+	if size < 0 {
+		size = 0
+	}
+	if size > 0 {
+		if err := stg.budget.acquire(ctx, size); err != nil {
+			return nil, fmt.Errorf("waiting for disk budget %w", err)
+		}
+	}
+
+	spilled, err := newSpillFile(stg.cnf.SpillDir, file.fileName)
+	if err != nil {
+		stg.budget.release(size)
+		return nil, err
+	}
+	spilled.budget = stg.budget
+	spilled.size = size
+
+	n, err := io.Copy(spilled, r)
+	if extra := n - held - size; extra > 0 {
+		stg.budget.grow(extra)
+		spilled.size += extra
+	}
+
+	return spilled, err
+}
+
+func zipReader(f *os.File) (*zip.Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(f, info.Size())
+}
+
+// sendEntry expands an archive entry, named "archive!entry", and waits until
+// it is closed. It returns false when ctx is cancelled.
+func (stg s3Stage) sendEntry(ctx context.Context, archive *S3File, name string, rc io.ReadCloser, sendResult func(*S3File)) bool {
+
+	closed := make(chan struct{})
+	var once sync.Once
+	entry := &S3File{
+		f: &readCloser{
+			Reader: rc,
+			close: func() error {
+				defer once.Do(func() { close(closed) })
+				return rc.Close()
+			},
+		},
+		fileName: archive.fileName + "!" + name,
+		meta:     archive.meta,
+		ack:      archive.ack.Derive(),
+	}
+
+	stg.expand(ctx, entry, sendResult)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-closed:
+		return true
+	}
+}
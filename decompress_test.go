@@ -0,0 +1,318 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// bzip2CSV is "a,b\n1,2\n" compressed with bzip2, the standard library has
+// no bzip2 writer.
+const bzip2CSV = "425a6839314159265359bf87407f00000359000010000430003000200030c00869b28823278bb9229c28485fc3a03f80"
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("zstd: %v", err)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func zipBytes(t *testing.T, files map[string]string, names ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("zip: %v", err)
+		}
+		f.Write([]byte(files[name]))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func tarBytes(t *testing.T, files map[string]string, names ...string) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range names {
+		w.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0600,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		})
+		w.Write([]byte(files[name]))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestExpand(t *testing.T) {
+
+	csv := "a,b\n1,2\n"
+	bz2, _ := hex.DecodeString(bzip2CSV)
+	entries := map[string]string{
+		"inner/one.csv": "a\n1\n",
+		"two.csv":       "a\n2\n",
+	}
+
+	cases := []struct {
+		name    string
+		content []byte
+		expect  map[string]string
+	}{
+		{
+			name:    "plain.csv",
+			content: []byte(csv),
+			expect:  map[string]string{"plain.csv": csv},
+		},
+		{
+			name:    "data.csv.gz",
+			content: gzipBytes(t, []byte(csv)),
+			expect:  map[string]string{"data.csv": csv},
+		},
+		{
+			name:    "data.csv.zst",
+			content: zstdBytes(t, []byte(csv)),
+			expect:  map[string]string{"data.csv": csv},
+		},
+		{
+			name:    "data.csv.bz2",
+			content: bz2,
+			expect:  map[string]string{"data.csv": csv},
+		},
+		{
+			// the magic bytes win over a missing extension
+			name:    "upload",
+			content: gzipBytes(t, []byte(csv)),
+			expect:  map[string]string{"upload": csv},
+		},
+		{
+			name:    "archive.zip",
+			content: zipBytes(t, entries, "inner/one.csv", "two.csv"),
+			expect: map[string]string{
+				"archive.zip!inner/one.csv": "a\n1\n",
+				"archive.zip!two.csv":       "a\n2\n",
+			},
+		},
+		{
+			name:    "archive.tar.gz",
+			content: gzipBytes(t, tarBytes(t, entries, "inner/one.csv", "two.csv")),
+			expect: map[string]string{
+				"archive.tar!inner/one.csv": "a\n1\n",
+				"archive.tar!two.csv":       "a\n2\n",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		acked := make(chan struct{})
+		root := NewAcker(func() { close(acked) }, nil)
+
+		stg := s3Stage{
+			cnf: S3Config{
+				SpillDir: t.TempDir(),
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+
+		source := &S3File{
+			f:        io.NopCloser(bytes.NewReader(c.content)),
+			fileName: c.name,
+			ack:      root.Derive(),
+		}
+		root.Ack()
+
+		resultCh := make(chan *S3File)
+		go func() {
+			defer close(resultCh)
+			stg.expand(ctx, source, func(f *S3File) { resultCh <- f })
+		}()
+
+		got := make(map[string]string)
+		var files []*S3File
+		for f := range resultCh {
+			if f.GetError() != nil {
+				t.Fatalf("case (%d) unexpected error %v", i, f.GetError())
+			}
+			content, err := io.ReadAll(f.File())
+			if err != nil {
+				t.Fatalf("case (%d) unexpected error %v", i, err)
+			}
+			got[f.FileName()] = string(content)
+			f.File().Close()
+			files = append(files, f)
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("case (%d) test timedout", i)
+		}
+		cancel()
+
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("case (%d) expecting %q got %q", i, c.expect, got)
+		}
+
+		for _, f := range files {
+			select {
+			case <-acked:
+				t.Fatalf("case (%d) acked before every entry was acked", i)
+			default:
+			}
+			f.GetAck().Ack()
+		}
+		select {
+		case <-acked:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("case (%d) expecting the source to be acked", i)
+		}
+	}
+}
+
+func TestExpandInvalidArchive(t *testing.T) {
+
+	nacked := make(chan error, 1)
+	root := NewAcker(nil, func(err error) { nacked <- err })
+
+	stg := s3Stage{}
+	resultCh := make(chan *S3File, 1)
+	stg.expand(context.Background(), &S3File{
+		f:        io.NopCloser(bytes.NewReader([]byte{0x1f, 0x8b, 0x00})),
+		fileName: "broken.csv.gz",
+		ack:      root.Derive(),
+	}, func(f *S3File) { resultCh <- f })
+	root.Ack()
+
+	if f := <-resultCh; f.GetError() == nil {
+		t.Fatalf("expecting an error event")
+	}
+	select {
+	case <-nacked:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expecting the source to be nacked")
+	}
+}
+
+func TestExpandZipBudget(t *testing.T) {
+
+	archive := gzipBytes(t, zipBytes(t, map[string]string{"one.csv": "a\n1\n"}, "one.csv"))
+	budget := newDiskBudget(1 << 20)
+	stg := s3Stage{
+		cnf: S3Config{
+			SpillDir: t.TempDir(),
+		},
+		budget: budget,
+	}
+	used := func() int64 {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		return budget.used
+	}
+
+	resultCh := make(chan *S3File)
+	go func() {
+		defer close(resultCh)
+		stg.expand(context.Background(), &S3File{
+			f:        io.NopCloser(bytes.NewReader(archive)),
+			fileName: "archive.zip.gz",
+			meta:     ObjectMeta{Size: int64(len(archive))},
+		}, func(f *S3File) { resultCh <- f })
+	}()
+
+	// the decompressed archive is charged while its entries are read
+	for f := range resultCh {
+		if f.GetError() != nil {
+			t.Fatalf("unexpected error %v", f.GetError())
+		}
+		if used() < int64(len(archive)) {
+			t.Fatalf("expecting the spilled archive to be charged got %d bytes", used())
+		}
+		f.File().Close()
+	}
+
+	if used() != 0 {
+		t.Fatalf("expecting the budget to be released got %d bytes", used())
+	}
+}
+
+func TestExpandDownloadedZipBudget(t *testing.T) {
+
+	archive := gzipBytes(t, zipBytes(t, map[string]string{"one.csv": "a\n1\n"}, "one.csv"))
+	size := int64(len(archive))
+	// the downloaded archive and its decompressed copy exceed the budget
+	budget := newDiskBudget(size * 3 / 2)
+	stg := s3Stage{
+		cnf: S3Config{
+			SpillDir: t.TempDir(),
+		},
+		budget: budget,
+	}
+	used := func() int64 {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		return budget.used
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := budget.acquire(ctx, size); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	downloaded, err := newSpillFile(stg.cnf.SpillDir, "archive.zip.gz")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	downloaded.budget = budget
+	downloaded.size = size
+	if _, err := downloaded.Write(archive); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	downloaded.Seek(0, io.SeekStart)
+
+	resultCh := make(chan *S3File)
+	go func() {
+		defer close(resultCh)
+		stg.expand(ctx, &S3File{
+			f:        downloaded,
+			fileName: "archive.zip.gz",
+			meta:     ObjectMeta{Size: size},
+		}, func(f *S3File) { resultCh <- f })
+	}()
+
+	entries := 0
+	for f := range resultCh {
+		if f.GetError() != nil {
+			t.Fatalf("unexpected error %v", f.GetError())
+		}
+		entries++
+		f.File().Close()
+	}
+	if entries != 1 {
+		t.Fatalf("expecting one entry got %d", entries)
+	}
+	if used() != 0 {
+		t.Fatalf("expecting the budget to be released got %d bytes", used())
+	}
+}
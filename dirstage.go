@@ -0,0 +1,286 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultDirPollInterval = 1 * time.Second
+
+// DirConfig configures the local directory source.
+type DirConfig struct {
+	Dir string
+	// Pattern is a filepath.Match glob the file names must match, e.g.
+	// "*.csv". Empty matches every file.
+	Pattern string
+	// Watch keeps scanning Dir for new files instead of reading the files
+	// it holds once.
+	Watch bool
+	// PollInterval is the time between two scans when watching, 1s by
+	// default.
+	PollInterval time.Duration
+	// StableFor is the time the size and modification time of a new file
+	// must not change before it is read when watching, PollInterval by
+	// default.
+	StableFor time.Duration
+	// DoneDir receives the files once every row is acked, Dir/done by
+	// default.
+	DoneDir string
+	// ErrorDir receives the files once a row is nacked, Dir/error by
+	// default. A file which can not be moved is reported as an error and
+	// read again by the next scan when watching.
+	ErrorDir string
+}
+
+func (cnf DirConfig) withDefaults() DirConfig {
+	if cnf.PollInterval <= 0 {
+		cnf.PollInterval = defaultDirPollInterval
+	}
+	if cnf.StableFor <= 0 {
+		cnf.StableFor = cnf.PollInterval
+	}
+	if cnf.DoneDir == "" {
+		cnf.DoneDir = filepath.Join(cnf.Dir, "done")
+	}
+	if cnf.ErrorDir == "" {
+		cnf.ErrorDir = filepath.Join(cnf.Dir, "error")
+	}
+	return cnf
+}
+
+func NewDirStage(cnf DirConfig) dirStage {
+	return dirStage{
+		cnf: cnf.withDefaults(),
+	}
+}
+
+type dirStage struct {
+	cnf DirConfig
+}
+
+// dirFile is the state of a file found by a scan.
+type dirFile struct {
+	size    int64
+	modTime time.Time
+	// since is when size and modTime were first seen.
+	since time.Time
+}
+
+// ReadFiles emits the files of the directory for csvProcessor.ProcessCSV,
+// in name order. A file is moved to DoneDir or ErrorDir once it is
+// resolved, files being processed are not emitted again.
+func (stg dirStage) ReadFiles(ctx context.Context) chan FileInfo {
+
+	resultCh := make(chan FileInfo)
+
+	sendResult := func(r *LocalFile) bool {
+		select {
+		case <-ctx.Done():
+			if r.f != nil {
+				r.f.Close()
+			}
+			return false
+		case resultCh <- r:
+			return true
+		}
+	}
+
+	// the files are moved once they resolve, possibly after the last scan
+	late := newLateErrors(func(err error) {
+		sendResult(&LocalFile{err: err})
+	})
+
+	go func() {
+		defer late.close(func() { close(resultCh) })
+		defer fmt.Println("dir closing")
+
+		for _, dir := range []string{stg.cnf.DoneDir, stg.cnf.ErrorDir} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				sendResult(&LocalFile{
+					err: wrapError(fmt.Errorf("readFiles: failed to create %v %w", dir, err)),
+				})
+				return
+			}
+		}
+
+		var mu sync.Mutex
+		inflight := make(map[string]bool)
+		candidates := make(map[string]dirFile)
+
+		for {
+			names, err := stg.scan()
+			if err != nil {
+				if !sendResult(&LocalFile{err: err}) {
+					return
+				}
+			}
+
+			now := time.Now()
+			found := make(map[string]bool, len(names))
+			for _, name := range names {
+				found[name] = true
+
+				mu.Lock()
+				busy := inflight[name]
+				mu.Unlock()
+				if busy {
+					continue
+				}
+
+				info, err := os.Stat(filepath.Join(stg.cnf.Dir, name))
+				if err != nil {
+					continue
+				}
+				if stg.cnf.Watch && !stable(candidates, name, info, now, stg.cnf.StableFor) {
+					continue
+				}
+				delete(candidates, name)
+
+				mu.Lock()
+				inflight[name] = true
+				mu.Unlock()
+
+				name := name
+				file := stg.open(name, info, func() {
+					mu.Lock()
+					delete(inflight, name)
+					mu.Unlock()
+				}, late.report)
+				if !sendResult(file) {
+					return
+				}
+			}
+			for name := range candidates {
+				if !found[name] {
+					delete(candidates, name)
+				}
+			}
+
+			if !stg.cnf.Watch {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(stg.cnf.PollInterval):
+			}
+		}
+	}()
+
+	return resultCh
+}
+
+// scan returns the names of the regular files of Dir matching Pattern.
+func (stg dirStage) scan() ([]string, error) {
+
+	entries, err := os.ReadDir(stg.cnf.Dir)
+	if err != nil {
+		return nil, wrapError(fmt.Errorf("readFiles: failed to read %v %w", stg.cnf.Dir, err))
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if stg.cnf.Pattern != "" {
+			if ok, _ := filepath.Match(stg.cnf.Pattern, entry.Name()); !ok {
+				continue
+			}
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// stable records the state of a file and tells whether it has not changed
+// for stableFor, a file still being written changes between scans.
+func stable(candidates map[string]dirFile, name string, info os.FileInfo, now time.Time, stableFor time.Duration) bool {
+	prev, ok := candidates[name]
+	if !ok || prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+		candidates[name] = dirFile{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			since:   now,
+		}
+		return false
+	}
+	return now.Sub(prev.since) >= stableFor
+}
+
+// open returns the event of a file whose acker moves it once resolved and
+// then calls release. A failed move goes to reportError.
+func (stg dirStage) open(name string, info os.FileInfo, release func(), reportError func(error)) *LocalFile {
+
+	path := filepath.Join(stg.cnf.Dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		release()
+		return &LocalFile{
+			err: wrapError(fmt.Errorf("readFiles: failed to open %v %w", path, err)),
+		}
+	}
+
+	// a file that can not be moved is released all the same, it is read
+	// again rather than held in flight forever. The error is reported
+	// apart, the consumer resolving the file may be the one to read it.
+	move := func(dir string) {
+		defer release()
+		if err := os.Rename(path, filepath.Join(dir, name)); err != nil {
+			go reportError(wrapError(fmt.Errorf("readFiles: failed to move %v to %v %w", path, dir, err)))
+		}
+	}
+
+	return &LocalFile{
+		f:        f,
+		fileName: name,
+		meta: ObjectMeta{
+			Key:       name,
+			Size:      info.Size(),
+			EventTime: info.ModTime(),
+		},
+		ack: NewAcker(func() {
+			move(stg.cnf.DoneDir)
+		}, func(error) {
+			move(stg.cnf.ErrorDir)
+		}),
+	}
+}
+
+// LocalFile is a file read from the local disk, from a directory or an
+// upload spilled to disk.
+type LocalFile struct {
+	f        io.ReadCloser
+	err      error
+	fileName string
+	meta     ObjectMeta
+	ack      *Acker
+}
+
+func (f *LocalFile) GetAck() *Acker {
+	return f.ack
+}
+
+func (f *LocalFile) GetError() error {
+	return f.err
+}
+
+func (f *LocalFile) FileName() string {
+	return f.fileName
+}
+
+func (f *LocalFile) File() io.ReadCloser {
+	return f.f
+}
+
+func (f *LocalFile) Meta() ObjectMeta {
+	return f.meta
+}
@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDirStageOnce(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.csv":   "a,b\n1,2\n",
+		"b.csv":   "a,b\n3,4\n5,6\n",
+		"c.txt":   "ignored\n",
+		"bad.csv": "a,b\n\"1,2\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("write %v: %v", name, err)
+		}
+	}
+
+	stg := NewDirStage(DirConfig{Dir: dir, Pattern: "*.csv"})
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	csvProcessor := NewCSVProcessor(',')
+	rows := make(map[string]int)
+	for row := range csvProcessor.ProcessCSV(ctx, stg.ReadFiles(ctx)) {
+		if row.GetError() != nil {
+			continue
+		}
+		rows[row.FileName()]++
+		row.GetAck().Ack()
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("test timedout")
+	}
+
+	expectRows := map[string]int{"a.csv": 1, "b.csv": 2}
+	if !reflect.DeepEqual(rows, expectRows) {
+		t.Fatalf("expecting rows %v got %v", expectRows, rows)
+	}
+
+	expect := map[string][]string{
+		dir:                         {"c.txt", "done", "error"},
+		filepath.Join(dir, "done"):  {"a.csv", "b.csv"},
+		filepath.Join(dir, "error"): {"bad.csv"},
+	}
+	for d, names := range expect {
+		var got []string
+		entries, _ := os.ReadDir(d)
+		for _, entry := range entries {
+			got = append(got, entry.Name())
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Fatalf("expecting %v in %v got %v", names, d, got)
+		}
+	}
+}
+
+func TestDirStageWatch(t *testing.T) {
+
+	dir := t.TempDir()
+	stg := NewDirStage(DirConfig{
+		Dir:          dir,
+		Watch:        true,
+		PollInterval: 10 * time.Millisecond,
+		StableFor:    30 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileCh := stg.ReadFiles(ctx)
+
+	// the file grows over a few scans and is read once complete
+	path := filepath.Join(dir, "a.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, line := range []string{"a,b\n", "1,2\n", "3,4\n"} {
+		f.WriteString(line)
+		time.Sleep(15 * time.Millisecond)
+	}
+	f.Close()
+
+	var file FileInfo
+	select {
+	case file = <-fileCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+	if file.GetError() != nil {
+		t.Fatalf("unexpected error %v", file.GetError())
+	}
+	if file.FileName() != "a.csv" || file.Meta().Size != 12 {
+		t.Fatalf("expecting a.csv of 12 bytes got %v of %d", file.FileName(), file.Meta().Size)
+	}
+
+	// a file in flight is not emitted again
+	select {
+	case file := <-fileCh:
+		t.Fatalf("unexpected file %v", file.FileName())
+	case <-time.After(60 * time.Millisecond):
+	}
+
+	file.File().Close()
+	file.GetAck().Ack()
+	if _, err := os.Stat(filepath.Join(dir, "done", "a.csv")); err != nil {
+		t.Fatalf("expecting a.csv to be moved to done %v", err)
+	}
+}
+
+func TestDirStageMoveFailed(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.csv"), []byte("a,b\n1,2\n"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	stg := NewDirStage(DirConfig{
+		Dir:          dir,
+		Watch:        true,
+		PollInterval: 10 * time.Millisecond,
+		StableFor:    10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileCh := stg.ReadFiles(ctx)
+
+	next := func() FileInfo {
+		select {
+		case file := <-fileCh:
+			return file
+		case <-time.After(1 * time.Second):
+			t.Fatalf("test timedout")
+		}
+		return nil
+	}
+
+	file := next()
+	if file.GetError() != nil {
+		t.Fatalf("unexpected error %v", file.GetError())
+	}
+	file.File().Close()
+
+	// the done directory is gone so the move fails
+	if err := os.RemoveAll(filepath.Join(dir, "done")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	file.GetAck().Ack()
+
+	// the failure is emitted and the file is read again
+	var failed, again bool
+	for !failed || !again {
+		file := next()
+		if file.GetError() != nil {
+			failed = true
+			continue
+		}
+		if file.FileName() != "a.csv" {
+			t.Fatalf("unexpected file %v", file.FileName())
+		}
+		file.File().Close()
+		again = true
+	}
+}
@@ -1,14 +1,14 @@
 package pipeline
 
 type GenericEvent struct {
-	Err  error
-	Done *func()
+	Err error
+	Ack *Acker
 }
 
 func (ee *GenericEvent) GetError() error {
 	return ee.Err
 }
 
-func (ge *GenericEvent) GetOnDone() *func() {
-	return ge.Done
+func (ge *GenericEvent) GetAck() *Acker {
+	return ge.Ack
 }
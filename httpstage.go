@@ -0,0 +1,448 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUploadPath     = "/upload"
+	defaultStatusPath     = "/status/"
+	defaultMaxUploadBytes = 100 << 20
+	defaultStatusTTL      = 1 * time.Hour
+)
+
+// HTTPConfig configures the upload server.
+type HTTPConfig struct {
+	// Addr is the address Serve listens on, e.g. ":8080".
+	Addr string
+	// Path receives the uploads, /upload by default.
+	Path string
+	// StatusPath serves the status of async uploads by id, /status/ by
+	// default.
+	StatusPath string
+	// Tokens are the accepted bearer tokens, the uploads are not
+	// authenticated when empty.
+	Tokens []string
+	// MaxBytes bounds the body of an upload, 100MB by default.
+	MaxBytes int64
+	// Async responds with 202 and a status URL once the upload is stored,
+	// instead of once every row is published.
+	Async bool
+	// StatusTTL is how long the status of a resolved async upload is
+	// kept, 1h by default.
+	StatusTTL time.Duration
+	// SpillDir holds the uploads, the system temp directory when empty.
+	SpillDir string
+}
+
+func (cnf HTTPConfig) withDefaults() HTTPConfig {
+	if cnf.Path == "" {
+		cnf.Path = defaultUploadPath
+	}
+	if cnf.StatusPath == "" {
+		cnf.StatusPath = defaultStatusPath
+	}
+	if cnf.MaxBytes <= 0 {
+		cnf.MaxBytes = defaultMaxUploadBytes
+	}
+	if cnf.StatusTTL <= 0 {
+		cnf.StatusTTL = defaultStatusTTL
+	}
+	return cnf
+}
+
+func NewHTTPStage(cnf HTTPConfig) *httpStage {
+	return &httpStage{
+		cnf:      cnf.withDefaults(),
+		resultCh: make(chan FileInfo),
+		statuses: make(map[string]*UploadStatus),
+	}
+}
+
+type httpStage struct {
+	cnf      HTTPConfig
+	resultCh chan FileInfo
+
+	mu       sync.Mutex
+	statuses map[string]*UploadStatus
+	serving  bool
+	// closed is set once Serve stopped, handlers counts the uploads in
+	// flight until then.
+	closed   bool
+	handlers sync.WaitGroup
+}
+
+// UploadStatus is the response to an upload and to a status request.
+type UploadStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Files  int    `json:"files"`
+	Rows   int    `json:"rows"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	uploadProcessing = "processing"
+	uploadDone       = "done"
+	uploadFailed     = "failed"
+)
+
+// Serve listens on Addr and emits one file per uploaded file until ctx is
+// cancelled, on the channel Files returns which it closes once the server
+// stopped. A stage is served once, a second call only emits an error.
+func (stg *httpStage) Serve(ctx context.Context) chan FileInfo {
+
+	stg.mu.Lock()
+	serving := stg.serving
+	stg.serving = true
+	stg.mu.Unlock()
+	if serving {
+		errCh := make(chan FileInfo, 1)
+		errCh <- &LocalFile{
+			err: wrapError(fmt.Errorf("serve: %v is already served", stg.cnf.Addr)),
+		}
+		close(errCh)
+		return errCh
+	}
+
+	srv := &http.Server{
+		Addr:    stg.cnf.Addr,
+		Handler: stg.Handler(ctx),
+	}
+
+	go func() {
+		defer close(stg.resultCh)
+		defer fmt.Println("HTTP closing")
+
+		shutdown := make(chan struct{})
+		go func() {
+			defer close(shutdown)
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			select {
+			case <-ctx.Done():
+			case stg.resultCh <- &LocalFile{
+				err: wrapError(fmt.Errorf("serve: %w", err)),
+			}:
+			}
+		}
+
+		// ListenAndServe returns as soon as Shutdown starts, Shutdown once
+		// the handlers returned. The uploads still in flight must not send
+		// on the closed channel.
+		if err == http.ErrServerClosed {
+			<-shutdown
+		}
+		stg.mu.Lock()
+		stg.closed = true
+		stg.mu.Unlock()
+		stg.handlers.Wait()
+	}()
+
+	return stg.resultCh
+}
+
+// Files returns the channel the uploaded files are emitted on, the one
+// Serve returns. Without Serve, with Handler mounted on another server, it
+// is never closed and its consumer stops with its context.
+func (stg *httpStage) Files() chan FileInfo {
+	return stg.resultCh
+}
+
+// Handler returns the handler of the uploads and of their status, for
+// servers other than the one of Serve. The files are emitted on the
+// channel Files returns.
+func (stg *httpStage) Handler(ctx context.Context) http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(stg.cnf.Path, func(w http.ResponseWriter, r *http.Request) {
+		stg.upload(ctx, w, r)
+	})
+	mux.HandleFunc(stg.cnf.StatusPath, stg.status)
+
+	return mux
+}
+
+func (stg *httpStage) authorized(r *http.Request) bool {
+	if len(stg.cnf.Tokens) == 0 {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, t := range stg.cnf.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// upload stores every file of the request to a spill file and emits it. The
+// files share an acker which resolves the request once every row is.
+func (stg *httpStage) upload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	stg.mu.Lock()
+	closed := stg.closed
+	if !closed {
+		stg.handlers.Add(1)
+	}
+	stg.mu.Unlock()
+	if closed {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer stg.handlers.Done()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !stg.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.ContentLength > stg.cnf.MaxBytes {
+		http.Error(w, "upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, stg.cnf.MaxBytes)
+
+	files, err := stg.spill(r)
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		// http.MaxBytesError is not available before go 1.19
+		code := http.StatusBadRequest
+		if strings.Contains(err.Error(), "request body too large") {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "no file uploaded", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := &UploadStatus{
+		ID:     id,
+		Status: uploadProcessing,
+		Files:  len(files),
+	}
+	resolved := make(chan struct{})
+	var root *Acker
+	root = NewAcker(func() {
+		stg.resolve(status, root.Leaves(), nil)
+		close(resolved)
+	}, func(err error) {
+		stg.resolve(status, root.Leaves(), err)
+		close(resolved)
+	})
+
+	if stg.cnf.Async {
+		stg.mu.Lock()
+		stg.statuses[status.ID] = status
+		stg.mu.Unlock()
+	}
+
+	for _, f := range files {
+		file := &LocalFile{
+			f:        f,
+			fileName: path.Base(f.name),
+			meta: ObjectMeta{
+				Key:       path.Base(f.name),
+				Size:      f.size,
+				EventTime: time.Now(),
+			},
+			ack: root.Derive(),
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			file.ack.Nack(ctx.Err())
+		case <-r.Context().Done():
+			f.Close()
+			file.ack.Nack(r.Context().Err())
+		case stg.resultCh <- file:
+		}
+	}
+	root.Ack()
+
+	if stg.cnf.Async {
+		w.Header().Set("Location", stg.cnf.StatusPath+status.ID)
+		stg.writeStatus(w, http.StatusAccepted, status)
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	case <-r.Context().Done():
+	case <-resolved:
+		code := http.StatusOK
+		if stg.snapshot(status).Status == uploadFailed {
+			code = http.StatusUnprocessableEntity
+		}
+		stg.writeStatus(w, code, status)
+	}
+}
+
+// uploadFile is an upload stored in a spill file.
+type uploadFile struct {
+	*spillFile
+	name string
+}
+
+// spill stores the files of a multipart request, or its raw body named
+// after the name query parameter, to spill files.
+func (stg *httpStage) spill(r *http.Request) ([]*uploadFile, error) {
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "upload"
+		}
+		f, err := stg.spillOne(name, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return []*uploadFile{f}, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("upload: invalid multipart body %w", err)
+	}
+
+	var files []*uploadFile
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, fmt.Errorf("upload: invalid multipart body %w", err)
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		f, err := stg.spillOne(part.FileName(), part)
+		part.Close()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+}
+
+func (stg *httpStage) spillOne(name string, r io.Reader) (*uploadFile, error) {
+
+	f, err := newSpillFile(stg.cnf.SpillDir, name)
+	if err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("upload: failed to store %v %w", name, err)
+	}
+	f.size = n
+
+	return &uploadFile{spillFile: f, name: name}, nil
+}
+
+func (stg *httpStage) resolve(status *UploadStatus, rows int, err error) {
+
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+
+	status.Rows = rows
+	status.Status = uploadDone
+	if err != nil {
+		status.Status = uploadFailed
+		status.Error = err.Error()
+	}
+
+	if stg.cnf.Async {
+		time.AfterFunc(stg.cnf.StatusTTL, func() {
+			stg.mu.Lock()
+			delete(stg.statuses, status.ID)
+			stg.mu.Unlock()
+		})
+	}
+}
+
+func (stg *httpStage) snapshot(status *UploadStatus) UploadStatus {
+	stg.mu.Lock()
+	defer stg.mu.Unlock()
+	return *status
+}
+
+func (stg *httpStage) status(w http.ResponseWriter, r *http.Request) {
+
+	if !stg.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, stg.cnf.StatusPath)
+	stg.mu.Lock()
+	status, ok := stg.statuses[id]
+	stg.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown upload", http.StatusNotFound)
+		return
+	}
+
+	stg.writeStatus(w, http.StatusOK, status)
+}
+
+func (stg *httpStage) writeStatus(w http.ResponseWriter, code int, status *UploadStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(stg.snapshot(status))
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("upload: failed to generate an id %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,308 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func multipartBody(t *testing.T, files map[string]string, names ...string) (*bytes.Buffer, string) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("comment", "not a file")
+	for _, name := range names {
+		part, err := w.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("multipart: %v", err)
+		}
+		part.Write([]byte(files[name]))
+	}
+	w.Close()
+	return &buf, w.FormDataContentType()
+}
+
+// startUploadServer serves stg and acks every row of the uploaded files.
+func startUploadServer(ctx context.Context, stg *httpStage) *httptest.Server {
+	go func() {
+		for row := range NewCSVProcessor(',').ProcessCSV(ctx, stg.Files()) {
+			if row.GetError() == nil {
+				row.GetAck().Ack()
+			}
+		}
+	}()
+	return httptest.NewServer(stg.Handler(ctx))
+}
+
+func TestHTTPUpload(t *testing.T) {
+
+	files := map[string]string{
+		"a.csv":    "a,b\n1,2\n3,4\n",
+		"b.csv":    "a,b\n5,6\n",
+		"bad.csv":  "a,b\n\"1,2\n",
+		"head.csv": "a,b\n",
+	}
+
+	cases := []struct {
+		token        string
+		name         string
+		raw          string
+		multipart    []string
+		expectCode   int
+		expectStatus UploadStatus
+		expectError  string
+	}{
+		{
+			token:      "wrong",
+			name:       "a.csv",
+			raw:        files["a.csv"],
+			expectCode: http.StatusUnauthorized,
+		},
+		{
+			token:      "secret",
+			name:       "a.csv",
+			raw:        strings.Repeat("a,b\n", 300),
+			expectCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			token:        "secret",
+			name:         "a.csv",
+			raw:          files["a.csv"],
+			expectCode:   http.StatusOK,
+			expectStatus: UploadStatus{Status: uploadDone, Files: 1, Rows: 2},
+		},
+		{
+			token:        "secret",
+			multipart:    []string{"a.csv", "b.csv"},
+			expectCode:   http.StatusOK,
+			expectStatus: UploadStatus{Status: uploadDone, Files: 2, Rows: 3},
+		},
+		{
+			// a file without rows counts none
+			token:        "secret",
+			multipart:    []string{"a.csv", "head.csv"},
+			expectCode:   http.StatusOK,
+			expectStatus: UploadStatus{Status: uploadDone, Files: 2, Rows: 2},
+		},
+		{
+			token:        "secret",
+			multipart:    []string{"b.csv", "bad.csv"},
+			expectCode:   http.StatusUnprocessableEntity,
+			expectStatus: UploadStatus{Status: uploadFailed, Files: 2, Rows: 1},
+			expectError:  "parseCSV: failed to read bad.csv file row",
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stg := NewHTTPStage(HTTPConfig{
+		Tokens:   []string{"other", "secret"},
+		MaxBytes: 1024,
+		SpillDir: t.TempDir(),
+	})
+	srv := startUploadServer(ctx, stg)
+	defer srv.Close()
+
+	for i, c := range cases {
+		var req *http.Request
+		if c.multipart != nil {
+			body, contentType := multipartBody(t, files, c.multipart...)
+			req, _ = http.NewRequest(http.MethodPost, srv.URL+"/upload", body)
+			req.Header.Set("Content-Type", contentType)
+		} else {
+			req, _ = http.NewRequest(http.MethodPost, srv.URL+"/upload?name="+c.name, strings.NewReader(c.raw))
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		if resp.StatusCode != c.expectCode {
+			t.Fatalf("case (%d) expecting code %d got %d", i, c.expectCode, resp.StatusCode)
+		}
+		if c.expectStatus.Status == "" {
+			resp.Body.Close()
+			continue
+		}
+
+		var status UploadStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		if status.ID == "" {
+			t.Fatalf("case (%d) expecting an upload id", i)
+		}
+		if !strings.HasPrefix(status.Error, c.expectError) {
+			t.Fatalf("case (%d) expecting error %q got %q", i, c.expectError, status.Error)
+		}
+		status.ID = ""
+		status.Error = ""
+		if status != c.expectStatus {
+			t.Fatalf("case (%d) expecting %+v got %+v", i, c.expectStatus, status)
+		}
+	}
+}
+
+func TestHTTPUploadAsync(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stg := NewHTTPStage(HTTPConfig{
+		Async:    true,
+		SpillDir: t.TempDir(),
+	})
+	srv := startUploadServer(ctx, stg)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/upload?name=a.csv", "text/csv", strings.NewReader("a,b\n1,2\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expecting code 202 got %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/status/") {
+		t.Fatalf("expecting a status url got %q", location)
+	}
+
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		resp, err := http.Get(srv.URL + location)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		var status UploadStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+
+		if status.Status == uploadDone {
+			if status.Rows != 1 || status.Files != 1 {
+				t.Fatalf("expecting 1 file and 1 row got %+v", status)
+			}
+			break
+		}
+		if status.Status != uploadProcessing || time.Now().After(deadline) {
+			t.Fatalf("unexpected status %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err = http.Get(srv.URL + "/status/unknown")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expecting code 404 got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPServeTwice(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stg := NewHTTPStage(HTTPConfig{Addr: "127.0.0.1:0"})
+	fileCh := stg.Serve(ctx)
+	if fileCh != stg.Files() {
+		t.Fatalf("expecting Serve to return the channel of Files")
+	}
+
+	var events []FileInfo
+	for event := range stg.Serve(ctx) {
+		events = append(events, event)
+	}
+	if len(events) != 1 || events[0].GetError() == nil {
+		t.Fatalf("expecting a single error got %v", events)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-fileCh:
+		if ok {
+			t.Fatalf("unexpected file")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+}
+
+func TestHTTPServeShutdownDuringUpload(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stg := NewHTTPStage(HTTPConfig{Addr: addr, SpillDir: t.TempDir()})
+	fileCh := stg.Serve(ctx)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for file := range fileCh {
+			if file.GetError() == nil {
+				file.File().Close()
+				file.GetAck().Ack()
+			}
+		}
+	}()
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expecting the server to listen %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the body is still being read when the server shuts down
+	body, bodyW := io.Pipe()
+	responded := make(chan error, 1)
+	go func() {
+		resp, err := http.Post("http://"+addr+"/upload?name=a.csv", "text/csv", body)
+		if err == nil {
+			resp.Body.Close()
+		}
+		responded <- err
+	}()
+
+	bodyW.Write([]byte("a,b\n"))
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	bodyW.Write([]byte("1,2\n"))
+	bodyW.Close()
+
+	select {
+	case err := <-responded:
+		if err != nil {
+			t.Fatalf("expecting a response got %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+	select {
+	case <-closed:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expecting the files channel to be closed")
+	}
+}
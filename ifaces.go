@@ -8,7 +8,7 @@ import (
 
 type GenericEventInt interface {
 	GetError() error
-	GetOnDone() *func()
+	GetAck() *Acker
 }
 
 type KafkaMessageInt interface {
@@ -19,18 +19,22 @@ type KafkaMessageInt interface {
 
 type FileInfo interface {
 	GenericEventInt
-	File() io.Reader
+	File() io.ReadCloser
 	FileName() string
+	Meta() ObjectMeta
 }
 
 type FileRow interface {
 	FileName() string
+	Line() int
 	Data() interface{}
+	Meta() ObjectMeta
 	GenericEventInt
 }
 
 type S3Notification interface {
 	Bucket() string
 	Key() string
+	Meta() ObjectMeta
 	GenericEventInt
 }
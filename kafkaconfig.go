@@ -0,0 +1,362 @@
+package pipeline
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	defaultKafkaDialTimeout = 10 * time.Second
+	defaultKafkaLinger      = 1 * time.Second
+	defaultKafkaBatchCount  = 100
+	defaultKafkaBatchBytes  = 1 << 20
+	// defaultKafkaMaxMessageBytes stays within the message.max.bytes
+	// default of the brokers.
+	defaultKafkaMaxMessageBytes = 1 << 20
+)
+
+// KafkaConfig configures the writer of the kafka stage.
+type KafkaConfig struct {
+	Brokers []string
+	SASL    KafkaSASL
+	TLS     KafkaTLS
+	// Compression is the codec of the written batches: gzip, snappy, lz4
+	// or zstd. Empty writes them uncompressed.
+	Compression string
+	// RequiredAcks is the number of replicas that must acknowledge a
+	// write: all, one or none. all by default.
+	RequiredAcks string
+	// DialTimeout bounds the connection to a broker, 10s by default.
+	DialTimeout time.Duration
+	// ReadTimeout and WriteTimeout bound the requests to the brokers, the
+	// writer defaults apply when zero.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Key selects the key of the value messages, the file name by default.
+	Key KafkaKey
+	// Routing chooses the topic of the value messages, the value topic of
+	// the stage by default.
+	Routing KafkaRouting
+	// Headers adds provenance and tracing headers to the value messages.
+	Headers KafkaHeaders
+	// Avro writes the value messages in Avro with the schemas of a schema
+	// registry, they are written as JSON by default.
+	Avro AvroConfig
+	// Balancer picks the partition of a message from its key: hash, crc32,
+	// murmur2, which matches the partitions of the Java producers, or
+	// least-bytes. hash by default. Messages without a key are spread over
+	// the partitions by all of them.
+	Balancer string
+	// MaxAttempts is the number of times the writer tries a batch before
+	// the write fails, the writer default applies when zero.
+	MaxAttempts int
+	// Linger writes a partial batch once its first message waited Linger,
+	// 1s by default.
+	Linger time.Duration
+	// BatchCount writes a batch once it holds BatchCount messages, 100 by
+	// default.
+	BatchCount int
+	// BatchBytes writes a batch before its keys, values and headers grow
+	// beyond BatchBytes, 1MB by default. A larger message, up to
+	// MaxMessageBytes, is written alone.
+	BatchBytes int
+	// MaxMessageBytes bounds the key, value and headers of a message plus
+	// 22 bytes of framing, 1MB by default. The error of a row whose message
+	// is larger is written to the error topic instead. It should not exceed
+	// the message.max.bytes of the brokers.
+	MaxMessageBytes int
+}
+
+func (cnf KafkaConfig) withDefaults() KafkaConfig {
+	if cnf.DialTimeout <= 0 {
+		cnf.DialTimeout = defaultKafkaDialTimeout
+	}
+	if cnf.Linger <= 0 {
+		cnf.Linger = defaultKafkaLinger
+	}
+	if cnf.BatchCount <= 0 {
+		cnf.BatchCount = defaultKafkaBatchCount
+	}
+	if cnf.BatchBytes <= 0 {
+		cnf.BatchBytes = defaultKafkaBatchBytes
+	}
+	if cnf.MaxMessageBytes <= 0 {
+		cnf.MaxMessageBytes = defaultKafkaMaxMessageBytes
+	}
+	return cnf
+}
+
+// KafkaSASL authenticates the writer to the brokers.
+type KafkaSASL struct {
+	// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512. Empty disables
+	// SASL.
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// KafkaTLS encrypts the connections to the brokers and verifies their
+// certificates.
+type KafkaTLS struct {
+	// Enabled turns TLS on, which setting any of the files or ServerName
+	// does as well.
+	Enabled bool
+	// CAFile is a PEM bundle of the authorities trusted on top of the
+	// system ones.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key of
+	// mutual TLS.
+	CertFile string
+	KeyFile  string
+	// ServerName is verified against the broker certificates instead of
+	// the broker host names.
+	ServerName string
+}
+
+func (t KafkaTLS) enabled() bool {
+	return t.Enabled || t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != ""
+}
+
+// KafkaConfigFromEnv reads a KafkaConfig from KAFKA_BROKERS, a comma
+// separated list, KAFKA_SASL_MECHANISM, KAFKA_USERNAME, KAFKA_PASSWORD,
+// KAFKA_TLS, KAFKA_CA_FILE, KAFKA_CERT_FILE, KAFKA_KEY_FILE,
+// KAFKA_TLS_SERVER_NAME, KAFKA_COMPRESSION, KAFKA_REQUIRED_ACKS,
+// KAFKA_BALANCER, KAFKA_KEY_COLUMNS, a comma separated list,
+// KAFKA_KEY_TEMPLATE, KAFKA_KEY_NONE, KAFKA_PROVENANCE_HEADERS,
+// KAFKA_TRACE_HEADERS and KAFKA_RUN_ID. TLS is enabled unless KAFKA_TLS is
+// false, and SASL PLAIN is used when a username is set without a mechanism.
+func KafkaConfigFromEnv() (KafkaConfig, error) {
+
+	brokers, exist := os.LookupEnv("KAFKA_BROKERS")
+	if !exist || brokers == "" {
+		return KafkaConfig{}, fmt.Errorf("kafkaConfig: KAFKA_BROKERS is empty")
+	}
+
+	tlsEnabled := true
+	if err := envBool("KAFKA_TLS", &tlsEnabled); err != nil {
+		return KafkaConfig{}, err
+	}
+
+	var key KafkaKey
+	if columns := os.Getenv("KAFKA_KEY_COLUMNS"); columns != "" {
+		key.Columns = strings.Split(columns, ",")
+	}
+	key.Template = os.Getenv("KAFKA_KEY_TEMPLATE")
+	if err := envBool("KAFKA_KEY_NONE", &key.None); err != nil {
+		return KafkaConfig{}, err
+	}
+
+	headers := KafkaHeaders{RunID: os.Getenv("KAFKA_RUN_ID")}
+	if err := envBool("KAFKA_PROVENANCE_HEADERS", &headers.Provenance); err != nil {
+		return KafkaConfig{}, err
+	}
+	if err := envBool("KAFKA_TRACE_HEADERS", &headers.Trace); err != nil {
+		return KafkaConfig{}, err
+	}
+
+	cnf := KafkaConfig{
+		Brokers: strings.Split(brokers, ","),
+		SASL: KafkaSASL{
+			Mechanism: os.Getenv("KAFKA_SASL_MECHANISM"),
+			Username:  os.Getenv("KAFKA_USERNAME"),
+			Password:  os.Getenv("KAFKA_PASSWORD"),
+		},
+		TLS: KafkaTLS{
+			Enabled:    tlsEnabled,
+			CAFile:     os.Getenv("KAFKA_CA_FILE"),
+			CertFile:   os.Getenv("KAFKA_CERT_FILE"),
+			KeyFile:    os.Getenv("KAFKA_KEY_FILE"),
+			ServerName: os.Getenv("KAFKA_TLS_SERVER_NAME"),
+		},
+		Compression:  os.Getenv("KAFKA_COMPRESSION"),
+		RequiredAcks: os.Getenv("KAFKA_REQUIRED_ACKS"),
+		Key:          key,
+		Headers:      headers,
+		Balancer:     os.Getenv("KAFKA_BALANCER"),
+	}
+	if cnf.SASL.Mechanism == "" && cnf.SASL.Username != "" {
+		cnf.SASL.Mechanism = plain.Mechanism{}.Name()
+	}
+
+	return cnf, nil
+}
+
+// envBool sets value from the environment variable name when it is set.
+func envBool(name string, value *bool) error {
+	v, exist := os.LookupEnv(name)
+	if !exist {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("kafkaConfig: invalid %v %w", name, err)
+	}
+	*value = b
+	return nil
+}
+
+// newKafkaWriter returns a writer for the brokers of cnf. The topic of
+// every message is set by the stage.
+func newKafkaWriter(cnf KafkaConfig) (*kafka.Writer, error) {
+
+	if len(cnf.Brokers) == 0 {
+		return nil, fmt.Errorf("kafkaConfig: no brokers")
+	}
+	cnf = cnf.withDefaults()
+
+	mechanism, err := cnf.SASL.mechanism()
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if cnf.TLS.enabled() {
+		if tlsConfig, err = cnf.TLS.config(); err != nil {
+			return nil, err
+		}
+	}
+
+	compression, err := kafkaCompression(cnf.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	acks, err := kafkaRequiredAcks(cnf.RequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+
+	balancer, err := kafkaBalancer(cnf.Balancer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stage batches the messages, the writer sends them right away.
+	// The writer rejects a message above its BatchBytes, which bounds the
+	// messages rather than the batches of the stage.
+	return &kafka.Writer{
+		Addr:         kafka.TCP(cnf.Brokers...),
+		Balancer:     balancer,
+		BatchSize:    cnf.BatchCount,
+		BatchBytes:   int64(cnf.MaxMessageBytes),
+		BatchTimeout: time.Millisecond,
+		Compression:  compression,
+		RequiredAcks: acks,
+		ReadTimeout:  cnf.ReadTimeout,
+		WriteTimeout: cnf.WriteTimeout,
+		MaxAttempts:  cnf.MaxAttempts,
+		Transport: &kafka.Transport{
+			DialTimeout: cnf.DialTimeout,
+			SASL:        mechanism,
+			TLS:         tlsConfig,
+		},
+	}, nil
+}
+
+func (s KafkaSASL) mechanism() (sasl.Mechanism, error) {
+
+	switch strings.ToUpper(s.Mechanism) {
+	case "":
+		return nil, nil
+	case "PLAIN":
+		return plain.Mechanism{
+			Username: s.Username,
+			Password: s.Password,
+		}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, s.Username, s.Password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, s.Username, s.Password)
+	}
+
+	return nil, fmt.Errorf("kafkaConfig: unsupported SASL mechanism %v", s.Mechanism)
+}
+
+func (t KafkaTLS) config() (*tls.Config, error) {
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.ServerName,
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafkaConfig: failed to read the CA bundle %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kafkaConfig: no certificate found in %v", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("kafkaConfig: a client certificate needs both CertFile and KeyFile")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafkaConfig: failed to load the client certificate %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func kafkaCompression(codec string) (kafka.Compression, error) {
+	switch strings.ToLower(codec) {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	}
+	return 0, fmt.Errorf("kafkaConfig: unsupported compression %v", codec)
+}
+
+func kafkaRequiredAcks(acks string) (kafka.RequiredAcks, error) {
+	switch strings.ToLower(acks) {
+	case "", "all", "-1":
+		return kafka.RequireAll, nil
+	case "one", "1":
+		return kafka.RequireOne, nil
+	case "none", "0":
+		return kafka.RequireNone, nil
+	}
+	return 0, fmt.Errorf("kafkaConfig: unsupported required acks %v", acks)
+}
+
+func kafkaBalancer(name string) (kafka.Balancer, error) {
+	switch strings.ToLower(name) {
+	case "", "hash":
+		return &kafka.Hash{}, nil
+	case "crc32":
+		return kafka.CRC32Balancer{}, nil
+	case "murmur2":
+		return kafka.Murmur2Balancer{}, nil
+	case "least-bytes":
+		return &kafka.LeastBytes{}, nil
+	}
+	return nil, fmt.Errorf("kafkaConfig: unsupported balancer %v", name)
+}
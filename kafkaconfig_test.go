@@ -0,0 +1,233 @@
+package pipeline
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// writeCert writes a self-signed certificate and its key to dir.
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cert: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestNewKafkaWriter(t *testing.T) {
+
+	certFile, keyFile := writeCert(t, t.TempDir())
+
+	cases := []struct {
+		cnf               KafkaConfig
+		expectErr         bool
+		expectMechanism   string
+		expectTLS         bool
+		expectServerName  string
+		expectClientCerts int
+		expectCompression kafka.Compression
+		expectAcks        kafka.RequiredAcks
+		expectBalancer    kafka.Balancer
+	}{
+		{
+			cnf:       KafkaConfig{},
+			expectErr: true,
+		},
+		{
+			cnf:            KafkaConfig{Brokers: []string{"b1:9092"}},
+			expectAcks:     kafka.RequireAll,
+			expectBalancer: &kafka.Hash{},
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers:      []string{"b1:9092", "b2:9092"},
+				SASL:         KafkaSASL{Mechanism: "SCRAM-SHA-512", Username: "user", Password: "password"},
+				TLS:          KafkaTLS{CAFile: certFile, ServerName: "kafka.internal"},
+				Compression:  "zstd",
+				RequiredAcks: "one",
+				Balancer:     "murmur2",
+			},
+			expectMechanism:   "SCRAM-SHA-512",
+			expectTLS:         true,
+			expectServerName:  "kafka.internal",
+			expectCompression: kafka.Zstd,
+			expectAcks:        kafka.RequireOne,
+			expectBalancer:    kafka.Murmur2Balancer{},
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers:  []string{"b1:9092"},
+				SASL:     KafkaSASL{Mechanism: "plain", Username: "user", Password: "password"},
+				TLS:      KafkaTLS{CertFile: certFile, KeyFile: keyFile},
+				Balancer: "LEAST-BYTES",
+			},
+			expectMechanism:   "PLAIN",
+			expectTLS:         true,
+			expectClientCerts: 1,
+			expectAcks:        kafka.RequireAll,
+			expectBalancer:    &kafka.LeastBytes{},
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers: []string{"b1:9092"},
+				TLS:     KafkaTLS{CertFile: certFile},
+			},
+			expectErr: true,
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers: []string{"b1:9092"},
+				TLS:     KafkaTLS{CAFile: keyFile},
+			},
+			expectErr: true,
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers: []string{"b1:9092"},
+				SASL:    KafkaSASL{Mechanism: "GSSAPI"},
+			},
+			expectErr: true,
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers:     []string{"b1:9092"},
+				Compression: "brotli",
+			},
+			expectErr: true,
+		},
+		{
+			cnf: KafkaConfig{
+				Brokers:  []string{"b1:9092"},
+				Balancer: "sticky",
+			},
+			expectErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		w, err := newKafkaWriter(c.cnf)
+		if c.expectErr {
+			if err == nil {
+				t.Fatalf("case (%d) expecting an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+
+		transport := w.Transport.(*kafka.Transport)
+		mechanism := ""
+		if transport.SASL != nil {
+			mechanism = transport.SASL.Name()
+		}
+		if mechanism != c.expectMechanism {
+			t.Fatalf("case (%d) expecting mechanism %q got %q", i, c.expectMechanism, mechanism)
+		}
+		if (transport.TLS != nil) != c.expectTLS {
+			t.Fatalf("case (%d) expecting tls %v got %v", i, c.expectTLS, transport.TLS)
+		}
+		if transport.TLS != nil {
+			if transport.TLS.InsecureSkipVerify {
+				t.Fatalf("case (%d) expecting the certificates to be verified", i)
+			}
+			if transport.TLS.ServerName != c.expectServerName || len(transport.TLS.Certificates) != c.expectClientCerts {
+				t.Fatalf("case (%d) unexpected tls config %+v", i, transport.TLS)
+			}
+		}
+		if w.Compression != c.expectCompression || w.RequiredAcks != c.expectAcks {
+			t.Fatalf("case (%d) expecting compression %v acks %v got %v %v", i, c.expectCompression, c.expectAcks, w.Compression, w.RequiredAcks)
+		}
+		if !reflect.DeepEqual(w.Balancer, c.expectBalancer) {
+			t.Fatalf("case (%d) expecting balancer %T got %T", i, c.expectBalancer, w.Balancer)
+		}
+		if w.Addr.String() != kafka.TCP(c.cnf.Brokers...).String() {
+			t.Fatalf("case (%d) expecting brokers %v got %v", i, c.cnf.Brokers, w.Addr)
+		}
+		// the batches of the stage do not bound the messages
+		if w.BatchBytes != defaultKafkaMaxMessageBytes {
+			t.Fatalf("case (%d) expecting batch bytes %d got %d", i, defaultKafkaMaxMessageBytes, w.BatchBytes)
+		}
+	}
+}
+
+func TestKafkaConfigFromEnv(t *testing.T) {
+
+	for _, name := range []string{"KAFKA_BROKERS", "KAFKA_SASL_MECHANISM", "KAFKA_TLS", "KAFKA_CA_FILE", "KAFKA_CERT_FILE", "KAFKA_KEY_FILE", "KAFKA_TLS_SERVER_NAME", "KAFKA_COMPRESSION", "KAFKA_REQUIRED_ACKS", "KAFKA_BALANCER", "KAFKA_KEY_COLUMNS", "KAFKA_KEY_TEMPLATE", "KAFKA_KEY_NONE", "KAFKA_PROVENANCE_HEADERS", "KAFKA_TRACE_HEADERS", "KAFKA_RUN_ID"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Setenv("KAFKA_USERNAME", "user")
+	t.Setenv("KAFKA_PASSWORD", "password")
+
+	if _, err := KafkaConfigFromEnv(); err == nil {
+		t.Fatalf("expecting an error when KAFKA_BROKERS is missing")
+	}
+
+	t.Setenv("KAFKA_BROKERS", "b1:9092,b2:9092")
+	t.Setenv("KAFKA_COMPRESSION", "gzip")
+	t.Setenv("KAFKA_BALANCER", "murmur2")
+	t.Setenv("KAFKA_KEY_COLUMNS", "country,id")
+	t.Setenv("KAFKA_PROVENANCE_HEADERS", "true")
+	t.Setenv("KAFKA_RUN_ID", "run-1")
+	cnf, err := KafkaConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expect := KafkaConfig{
+		Brokers:     []string{"b1:9092", "b2:9092"},
+		SASL:        KafkaSASL{Mechanism: "PLAIN", Username: "user", Password: "password"},
+		TLS:         KafkaTLS{Enabled: true},
+		Compression: "gzip",
+		Balancer:    "murmur2",
+		Key:         KafkaKey{Columns: []string{"country", "id"}},
+		Headers:     KafkaHeaders{Provenance: true, RunID: "run-1"},
+	}
+	if !reflect.DeepEqual(cnf, expect) {
+		t.Fatalf("expecting %+v got %+v", expect, cnf)
+	}
+
+	t.Setenv("KAFKA_KEY_NONE", "maybe")
+	if _, err := KafkaConfigFromEnv(); err == nil {
+		t.Fatalf("expecting an error for an invalid KAFKA_KEY_NONE")
+	}
+
+	t.Setenv("KAFKA_TLS", "maybe")
+	if _, err := KafkaConfigFromEnv(); err == nil {
+		t.Fatalf("expecting an error for an invalid KAFKA_TLS")
+	}
+}
@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// The headers of the value messages.
+const (
+	HeaderSourceBucket    = "source-bucket"
+	HeaderSourceKey       = "source-key"
+	HeaderSourceVersionID = "source-version-id"
+	HeaderSourceLine      = "source-line"
+	HeaderContentSHA256   = "content-sha256"
+	HeaderRunID           = "pipeline-run-id"
+	HeaderTraceParent     = "traceparent"
+)
+
+// KafkaHeaders adds provenance and tracing headers to the value messages.
+type KafkaHeaders struct {
+	// Provenance adds the source-bucket, source-key, source-version-id,
+	// source-line and content-sha256 headers. The ones without a value,
+	// such as the version of an unversioned object, are left out.
+	Provenance bool
+	// RunID is the pipeline-run-id header, left out when empty.
+	RunID string
+	// Trace adds a W3C traceparent header. The rows of an object share a
+	// trace derived from RunID and the object, each row being a span of it.
+	Trace bool
+}
+
+func (h KafkaHeaders) enabled() bool {
+	return h.Provenance || h.RunID != "" || h.Trace
+}
+
+// headers returns the headers of the message of fileRow holding value.
+func (h KafkaHeaders) headers(fileRow FileRow, value []byte) []kafka.Header {
+
+	if !h.enabled() {
+		return nil
+	}
+
+	var headers []kafka.Header
+	add := func(key, value string) {
+		if value != "" {
+			headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+	}
+
+	meta := fileRow.Meta()
+	if h.Provenance {
+		add(HeaderSourceBucket, meta.Bucket)
+		add(HeaderSourceKey, meta.Key)
+		add(HeaderSourceVersionID, meta.VersionID)
+		if fileRow.Line() > 0 {
+			add(HeaderSourceLine, strconv.Itoa(fileRow.Line()))
+		}
+		sum := sha256.Sum256(value)
+		add(HeaderContentSHA256, hex.EncodeToString(sum[:]))
+	}
+	add(HeaderRunID, h.RunID)
+	if h.Trace {
+		add(HeaderTraceParent, h.traceParent(meta, fileRow.Line()))
+	}
+
+	return headers
+}
+
+// traceParent returns a sampled W3C trace context whose trace id hashes the
+// run and the object, and whose span id hashes the trace and the line.
+func (h KafkaHeaders) traceParent(meta ObjectMeta, line int) string {
+	trace := sha256.Sum256([]byte(h.RunID + "\x00" + meta.Bucket + "\x00" + meta.Key + "\x00" + meta.VersionID))
+	traceID := hex.EncodeToString(trace[:16])
+	span := sha256.Sum256([]byte(traceID + "\x00" + strconv.Itoa(line)))
+	return fmt.Sprintf("00-%v-%v-01", traceID, hex.EncodeToString(span[:8]))
+}
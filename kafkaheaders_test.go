@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaHeaders(t *testing.T) {
+
+	row := func(version string, line int) *csvRow {
+		return &csvRow{
+			data:     map[string]string{"id": "1"},
+			fileName: "a.csv",
+			line:     line,
+			meta:     ObjectMeta{Bucket: "bucket", Key: "in/a.csv", VersionID: version},
+		}
+	}
+	value := []byte(`{"id":"1"}`)
+	sum := sha256.Sum256(value)
+
+	cases := []struct {
+		headers    KafkaHeaders
+		row        FileRow
+		expectKeys []string
+	}{
+		{
+			headers:    KafkaHeaders{},
+			row:        row("v1", 3),
+			expectKeys: nil,
+		},
+		{
+			headers:    KafkaHeaders{Provenance: true},
+			row:        row("v1", 3),
+			expectKeys: []string{HeaderSourceBucket, HeaderSourceKey, HeaderSourceVersionID, HeaderSourceLine, HeaderContentSHA256},
+		},
+		{
+			headers:    KafkaHeaders{Provenance: true, RunID: "run-1", Trace: true},
+			row:        row("", 3),
+			expectKeys: []string{HeaderSourceBucket, HeaderSourceKey, HeaderSourceLine, HeaderContentSHA256, HeaderRunID, HeaderTraceParent},
+		},
+	}
+
+	for i, c := range cases {
+		headers := c.headers.headers(c.row, value)
+		if len(headers) != len(c.expectKeys) {
+			t.Fatalf("case (%d) expecting headers %v got %v", i, c.expectKeys, headers)
+		}
+		for j, h := range headers {
+			if h.Key != c.expectKeys[j] {
+				t.Fatalf("case (%d) expecting header %v got %v", i, c.expectKeys[j], h.Key)
+			}
+		}
+
+		values := make(map[string]string)
+		for _, h := range headers {
+			values[h.Key] = string(h.Value)
+		}
+		if v, ok := values[HeaderSourceLine]; ok && v != "3" {
+			t.Fatalf("case (%d) expecting line 3 got %v", i, v)
+		}
+		if v, ok := values[HeaderContentSHA256]; ok && v != hex.EncodeToString(sum[:]) {
+			t.Fatalf("case (%d) unexpected content hash %v", i, v)
+		}
+	}
+}
+
+func TestKafkaHeadersTrace(t *testing.T) {
+
+	h := KafkaHeaders{RunID: "run-1", Trace: true}
+	traceParent := regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-01$`)
+
+	meta := ObjectMeta{Bucket: "bucket", Key: "in/a.csv"}
+	first := traceParent.FindStringSubmatch(h.traceParent(meta, 1))
+	second := traceParent.FindStringSubmatch(h.traceParent(meta, 2))
+	if first == nil || second == nil {
+		t.Fatalf("expecting W3C trace contexts got %v %v", first, second)
+	}
+	// the rows of an object share the trace, not the span
+	if first[1] != second[1] || first[2] == second[2] {
+		t.Fatalf("expecting a shared trace and distinct spans got %v %v", first, second)
+	}
+
+	other := traceParent.FindStringSubmatch(h.traceParent(ObjectMeta{Bucket: "bucket", Key: "in/b.csv"}, 1))
+	if other[1] == first[1] {
+		t.Fatalf("expecting objects to have their own trace")
+	}
+}
+
+func TestCreateMessageHeaders(t *testing.T) {
+
+	ks := &kafkaStage{
+		valueTopic: "value",
+		errorTopic: "error",
+		headers:    KafkaHeaders{Provenance: true},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileRowCh := make(chan FileRow, 1)
+	fileRowCh <- &csvRow{
+		data:     map[string]string{"id": "1"},
+		fileName: "a.csv",
+		line:     4,
+		meta:     ObjectMeta{Bucket: "bucket", Key: "in/a.csv"},
+	}
+	result := ks.CreateMessage(ctx, fileRowCh)
+
+	select {
+	case r := <-result:
+		expect := []kafka.Header{
+			{Key: HeaderSourceBucket, Value: []byte("bucket")},
+			{Key: HeaderSourceKey, Value: []byte("in/a.csv")},
+			{Key: HeaderSourceLine, Value: []byte("4")},
+		}
+		headers := r.Message().Headers
+		if len(headers) != 4 {
+			t.Fatalf("expecting 4 headers got %v", headers)
+		}
+		for i, h := range expect {
+			if headers[i].Key != h.Key || string(headers[i].Value) != string(h.Value) {
+				t.Fatalf("expecting header %v=%s got %v=%s", h.Key, h.Value, headers[i].Key, headers[i].Value)
+			}
+		}
+		if string(r.Message().Value) != `{"id":"1"}` {
+			t.Fatalf("unexpected value %s", r.Message().Value)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timedout!")
+	}
+}
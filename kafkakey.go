@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const defaultKeySeparator = "|"
+
+// KafkaKey selects the key of the value messages, which the balancer
+// partitions them by. The file name is the key when none is set.
+type KafkaKey struct {
+	// Columns keys a row by the values of these CSV columns, joined by
+	// Separator.
+	Columns []string
+	// Separator joins the column values, | by default.
+	Separator string
+	// Template keys a row by a text/template executed with the fields of
+	// keyData, e.g. {{.Bucket}}/{{.Key}}:{{.Line}} or {{.Row.id}}.
+	Template string
+	// None writes the messages without a key, the balancer spreads them
+	// over the partitions.
+	None bool
+}
+
+// keyData is what a key or topic template is executed with.
+type keyData struct {
+	Bucket string
+	Key    string
+	File   string
+	Line   string
+	Row    map[string]string
+}
+
+func newKeyData(fileRow FileRow) keyData {
+	row, _ := fileRow.Data().(map[string]string)
+	return keyData{
+		Bucket: fileRow.Meta().Bucket,
+		Key:    fileRow.Meta().Key,
+		File:   fileRow.FileName(),
+		Line:   fmt.Sprint(fileRow.Line()),
+		Row:    row,
+	}
+}
+
+// messageKey returns the key of the message of a row.
+type messageKey func(fileRow FileRow) ([]byte, error)
+
+func fileNameKey(fileRow FileRow) ([]byte, error) {
+	return []byte(fileRow.FileName()), nil
+}
+
+// keyFunc returns the messageKey k selects.
+func (k KafkaKey) keyFunc() (messageKey, error) {
+
+	set := 0
+	for _, isSet := range []bool{len(k.Columns) > 0, k.Template != "", k.None} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("kafkaKey: only one of Columns, Template and None can be set")
+	}
+
+	switch {
+	case k.None:
+		return func(FileRow) ([]byte, error) {
+			return nil, nil
+		}, nil
+	case len(k.Columns) > 0:
+		return k.columnsKey(), nil
+	case k.Template != "":
+		return k.templateKey()
+	}
+
+	return fileNameKey, nil
+}
+
+func (k KafkaKey) columnsKey() messageKey {
+
+	sep := k.Separator
+	if sep == "" {
+		sep = defaultKeySeparator
+	}
+
+	return func(fileRow FileRow) ([]byte, error) {
+		row, ok := fileRow.Data().(map[string]string)
+		if !ok {
+			return nil, fmt.Errorf("kafkaKey: the rows of %v have no columns", fileRow.FileName())
+		}
+
+		values := make([]string, len(k.Columns))
+		for i, column := range k.Columns {
+			value, exist := row[column]
+			if !exist {
+				return nil, fmt.Errorf("kafkaKey: the rows of %v have no %v column", fileRow.FileName(), column)
+			}
+			values[i] = value
+		}
+		return []byte(strings.Join(values, sep)), nil
+	}
+}
+
+func (k KafkaKey) templateKey() (messageKey, error) {
+
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(k.Template)
+	if err != nil {
+		return nil, fmt.Errorf("kafkaKey: invalid template %w", err)
+	}
+
+	return func(fileRow FileRow) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, newKeyData(fileRow)); err != nil {
+			return nil, fmt.Errorf("kafkaKey: failed to key a row of %v %w", fileRow.FileName(), err)
+		}
+		return buf.Bytes(), nil
+	}, nil
+}
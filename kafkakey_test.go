@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKafkaKey(t *testing.T) {
+
+	row := &csvRow{
+		data:     map[string]string{"id": "42", "country": "nl"},
+		fileName: "a.csv",
+		line:     7,
+		meta:     ObjectMeta{Bucket: "bucket", Key: "in/a.csv"},
+	}
+
+	cases := []struct {
+		key          KafkaKey
+		row          FileRow
+		expectKey    []byte
+		expectErr    bool
+		expectKeyErr bool
+	}{
+		{
+			key:       KafkaKey{},
+			row:       row,
+			expectKey: []byte("a.csv"),
+		},
+		{
+			key:       KafkaKey{None: true},
+			row:       row,
+			expectKey: nil,
+		},
+		{
+			key:       KafkaKey{Columns: []string{"country", "id"}},
+			row:       row,
+			expectKey: []byte("nl|42"),
+		},
+		{
+			key:       KafkaKey{Columns: []string{"id"}, Separator: ","},
+			row:       row,
+			expectKey: []byte("42"),
+		},
+		{
+			key:          KafkaKey{Columns: []string{"missing"}},
+			row:          row,
+			expectKeyErr: true,
+		},
+		{
+			key:          KafkaKey{Columns: []string{"id"}},
+			row:          &csvRow{data: []string{"42"}, fileName: "a.csv"},
+			expectKeyErr: true,
+		},
+		{
+			key:       KafkaKey{Template: "{{.Bucket}}/{{.Key}}:{{.Line}}:{{.Row.id}}"},
+			row:       row,
+			expectKey: []byte("bucket/in/a.csv:7:42"),
+		},
+		{
+			key:          KafkaKey{Template: "{{.Row.missing}}"},
+			row:          row,
+			expectKeyErr: true,
+		},
+		{
+			key:       KafkaKey{Template: "{{.Row.id"},
+			expectErr: true,
+		},
+		{
+			key:       KafkaKey{Columns: []string{"id"}, None: true},
+			expectErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		keyFunc, err := c.key.keyFunc()
+		if c.expectErr {
+			if err == nil {
+				t.Fatalf("case (%d) expecting an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+
+		key, err := keyFunc(c.row)
+		if c.expectKeyErr {
+			if err == nil {
+				t.Fatalf("case (%d) expecting a key error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		if (key == nil) != (c.expectKey == nil) || string(key) != string(c.expectKey) {
+			t.Fatalf("case (%d) expecting key %q got %q", i, c.expectKey, key)
+		}
+	}
+}
+
+func TestCreateMessageKeyError(t *testing.T) {
+
+	keyFunc, err := KafkaKey{Columns: []string{"missing"}}.keyFunc()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ks := &kafkaStage{
+		valueTopic: "value",
+		errorTopic: "error",
+		key:        keyFunc,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fileRowCh := make(chan FileRow, 1)
+	fileRowCh <- &csvRow{data: map[string]string{"id": "42"}, fileName: "a.csv"}
+	result := ks.CreateMessage(ctx, fileRowCh)
+
+	select {
+	case r := <-result:
+		msg := r.Message()
+		if msg.Topic != "error" || string(msg.Key) != "a.csv" || !strings.Contains(string(msg.Value), "no missing column") {
+			t.Fatalf("expecting an error message got %v %q %q", msg.Topic, msg.Key, msg.Value)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timedout!")
+	}
+}
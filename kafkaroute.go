@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// What the kafka stage does with the rows no route matches.
+const (
+	// UnmatchedDefault writes them to the value topic of the stage.
+	UnmatchedDefault = "default"
+	// UnmatchedError writes an error for each of them to the error topic.
+	UnmatchedError = "error"
+	// UnmatchedDrop acks them without writing them.
+	UnmatchedDrop = "drop"
+)
+
+// KafkaRouting chooses the topic of the value messages. The first route
+// matching a row picks its topic.
+type KafkaRouting struct {
+	Routes []KafkaRoute
+	// Unmatched is UnmatchedDefault, UnmatchedError or UnmatchedDrop,
+	// UnmatchedDefault when empty.
+	Unmatched string
+}
+
+// KafkaRoute matches the rows meeting all of its conditions, a route
+// without any matches every row.
+type KafkaRoute struct {
+	// Prefix matches the rows of the objects whose key starts with Prefix.
+	Prefix string
+	// Pattern matches the rows of the files whose name matches it, see
+	// path.Match.
+	Pattern string
+	// Columns matches the rows holding these column values.
+	Columns map[string]string
+	// Topic is a text/template executed with the fields of keyData, e.g.
+	// events-{{.Row.record_type}}.
+	Topic string
+}
+
+type topicRoute struct {
+	KafkaRoute
+	topic *template.Template
+}
+
+// topicRouter returns the topic of the message of a row.
+type topicRouter struct {
+	routes       []topicRoute
+	defaultTopic string
+	unmatched    string
+}
+
+// router compiles the routes of r, the rows no route matches go to
+// defaultTopic unless Unmatched says otherwise.
+func (r KafkaRouting) router(defaultTopic string) (*topicRouter, error) {
+
+	unmatched := strings.ToLower(r.Unmatched)
+	switch unmatched {
+	case "":
+		unmatched = UnmatchedDefault
+	case UnmatchedDefault, UnmatchedError, UnmatchedDrop:
+	default:
+		return nil, fmt.Errorf("kafkaRouting: unsupported unmatched handling %v", r.Unmatched)
+	}
+
+	router := &topicRouter{
+		defaultTopic: defaultTopic,
+		unmatched:    unmatched,
+	}
+	for i, route := range r.Routes {
+		if route.Topic == "" {
+			return nil, fmt.Errorf("kafkaRouting: route %d has no topic", i)
+		}
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("kafkaRouting: invalid pattern of route %d %w", i, err)
+		}
+		tmpl, err := template.New("topic").Option("missingkey=error").Parse(route.Topic)
+		if err != nil {
+			return nil, fmt.Errorf("kafkaRouting: invalid topic of route %d %w", i, err)
+		}
+		router.routes = append(router.routes, topicRoute{KafkaRoute: route, topic: tmpl})
+	}
+
+	return router, nil
+}
+
+// topic returns the topic of the message of fileRow, ok is false when the
+// row is dropped.
+func (tr *topicRouter) topic(fileRow FileRow) (topic string, ok bool, err error) {
+
+	for _, route := range tr.routes {
+		if !route.matches(fileRow) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := route.topic.Execute(&buf, newKeyData(fileRow)); err != nil {
+			return "", false, fmt.Errorf("kafkaRouting: failed to route a row of %v %w", fileRow.FileName(), err)
+		}
+		if buf.Len() == 0 {
+			return "", false, fmt.Errorf("kafkaRouting: empty topic for a row of %v", fileRow.FileName())
+		}
+		return buf.String(), true, nil
+	}
+
+	switch tr.unmatched {
+	case UnmatchedError:
+		return "", false, fmt.Errorf("kafkaRouting: no route matches a row of %v", fileRow.FileName())
+	case UnmatchedDrop:
+		return "", false, nil
+	}
+	return tr.defaultTopic, true, nil
+}
+
+func (route topicRoute) matches(fileRow FileRow) bool {
+
+	if !strings.HasPrefix(fileRow.Meta().Key, route.Prefix) {
+		return false
+	}
+	if route.Pattern != "" {
+		if ok, _ := path.Match(route.Pattern, fileRow.FileName()); !ok {
+			return false
+		}
+	}
+	if len(route.Columns) == 0 {
+		return true
+	}
+
+	row, ok := fileRow.Data().(map[string]string)
+	if !ok {
+		return false
+	}
+	for column, value := range route.Columns {
+		if v, exist := row[column]; !exist || v != value {
+			return false
+		}
+	}
+	return true
+}
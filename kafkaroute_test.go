@@ -0,0 +1,147 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKafkaRouting(t *testing.T) {
+
+	routing := KafkaRouting{
+		Routes: []KafkaRoute{
+			{Prefix: "orders/", Columns: map[string]string{"record_type": "refund"}, Topic: "refunds"},
+			{Prefix: "orders/", Topic: "orders-{{.Row.record_type}}"},
+			{Pattern: "*.tsv", Topic: "tsv"},
+		},
+	}
+
+	row := func(key, record string) *csvRow {
+		data := map[string]string{"id": "1"}
+		if record != "" {
+			data["record_type"] = record
+		}
+		return &csvRow{
+			data:     data,
+			fileName: key[strings.LastIndex(key, "/")+1:],
+			meta:     ObjectMeta{Bucket: "bucket", Key: key},
+		}
+	}
+
+	cases := []struct {
+		unmatched   string
+		row         FileRow
+		expectTopic string
+		expectDrop  bool
+		expectErr   bool
+	}{
+		{
+			row:         row("orders/2022/a.csv", "refund"),
+			expectTopic: "refunds",
+		},
+		{
+			row:         row("orders/2022/a.csv", "sale"),
+			expectTopic: "orders-sale",
+		},
+		{
+			// the topic template needs the record_type column
+			row:       row("orders/2022/a.csv", ""),
+			expectErr: true,
+		},
+		{
+			row:         row("users/a.tsv", ""),
+			expectTopic: "tsv",
+		},
+		{
+			row:         row("users/a.csv", ""),
+			expectTopic: "value",
+		},
+		{
+			unmatched: UnmatchedError,
+			row:       row("users/a.csv", ""),
+			expectErr: true,
+		},
+		{
+			unmatched:  UnmatchedDrop,
+			row:        row("users/a.csv", ""),
+			expectDrop: true,
+		},
+	}
+
+	for i, c := range cases {
+		routing.Unmatched = c.unmatched
+		router, err := routing.router("value")
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+
+		topic, ok, err := router.topic(c.row)
+		if c.expectErr {
+			if err == nil {
+				t.Fatalf("case (%d) expecting an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		if ok == c.expectDrop || topic != c.expectTopic {
+			t.Fatalf("case (%d) expecting topic %q drop %v got %q %v", i, c.expectTopic, c.expectDrop, topic, ok)
+		}
+	}
+
+	invalid := []KafkaRouting{
+		{Unmatched: "ignore"},
+		{Routes: []KafkaRoute{{Prefix: "orders/"}}},
+		{Routes: []KafkaRoute{{Pattern: "[", Topic: "t"}}},
+		{Routes: []KafkaRoute{{Topic: "{{.Row"}}},
+	}
+	for i, routing := range invalid {
+		if _, err := routing.router("value"); err == nil {
+			t.Fatalf("case (%d) expecting an error", i)
+		}
+	}
+}
+
+func TestCreateMessageRouting(t *testing.T) {
+
+	router, err := KafkaRouting{
+		Routes:    []KafkaRoute{{Columns: map[string]string{"keep": "yes"}, Topic: "kept"}},
+		Unmatched: UnmatchedDrop,
+	}.router("value")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ks := &kafkaStage{
+		valueTopic: "value",
+		errorTopic: "error",
+		router:     router,
+	}
+
+	acked := 0
+	root := NewAcker(func() { acked++ }, nil)
+	fileRowCh := make(chan FileRow, 2)
+	fileRowCh <- &csvRow{data: map[string]string{"keep": "no"}, fileName: "a.csv", ack: root.Derive()}
+	fileRowCh <- &csvRow{data: map[string]string{"keep": "yes"}, fileName: "a.csv", ack: root.Derive()}
+	root.Ack()
+	close(fileRowCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	var topics []string
+	for msg := range ks.CreateMessage(ctx, fileRowCh) {
+		topics = append(topics, msg.Message().Topic)
+		msg.GetAck().Ack()
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("test timedout")
+	}
+
+	if len(topics) != 1 || topics[0] != "kept" {
+		t.Fatalf("expecting a single message to kept got %v", topics)
+	}
+	if acked != 1 {
+		t.Fatalf("expecting the dropped row to be acked")
+	}
+}
@@ -2,31 +2,56 @@ package pipeline
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
-	"github.com/segmentio/kafka-go/sasl/plain"
 )
 
-func NewKafkaStege(valueTopic, errorTopic string) *kafkaStage {
+func NewKafkaStege(cnf KafkaConfig, valueTopic, errorTopic string) (*kafkaStage, error) {
 
-	batcher := NewMessageBatcher()
-	return &kafkaStage{
-		valueTopic:     valueTopic,
-		errorTopic:     errorTopic,
-		messageBatcher: batcher,
+	key, err := cnf.Key.keyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := cnf.Routing.router(valueTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	serializer, err := cnf.Avro.serializer()
+	if err != nil {
+		return nil, err
+	}
+
+	batcher, err := NewMessageBatcher(cnf)
+	if err != nil {
+		return nil, err
 	}
+	return &kafkaStage{
+		valueTopic:      valueTopic,
+		errorTopic:      errorTopic,
+		key:             key,
+		router:          router,
+		headers:         cnf.Headers,
+		serializer:      serializer,
+		maxMessageBytes: cnf.withDefaults().MaxMessageBytes,
+		messageBatcher:  batcher,
+	}, nil
 }
 
 type kafkaStage struct {
 	errorTopic string
 	valueTopic string
+	key        messageKey
+	router     *topicRouter
+	headers    KafkaHeaders
+	serializer valueSerializer
+	// maxMessageBytes bounds the value messages, 0 means unbounded.
+	maxMessageBytes int
 	*messageBatcher
 }
 
@@ -53,61 +78,58 @@ func (kafkaStage *kafkaStage) CreateMessage(ctx context.Context, fileRowCh chan
 					return
 				}
 
-				var errEvent *kafkaMessage
 				if fileRow.GetError() != nil {
+					sendResult(kafkaStage.errorMessage(fileRow.FileName(), fileRow.GetError(), fileRow.GetAck()))
+					break
+				}
 
-					var appErr *AppError
-
-					if errors.As(fileRow.GetError(), &appErr) {
-						data, err := appErr.toJSON()
-						if err != nil {
-							panic(fmt.Errorf("CreateKafkaMessage: error toJson failed %w", err))
-						}
-
-						errEvent = &kafkaMessage{
-							msg: &kafka.Message{
-								Topic: kafkaStage.errorTopic,
-								Key:   []byte(fileRow.FileName()),
-								Value: data,
-							},
-						}
-
-					} else {
-
-						errEvent = &kafkaMessage{
-							msg: &kafka.Message{
-								Topic: kafkaStage.errorTopic,
-								Key:   []byte(fileRow.FileName()),
-								Value: []byte(fileRow.GetError().Error()),
-							},
-						}
-
-					}
-
-					sendResult(errEvent)
-
-				} else {
-					row := (fileRow.Data()).(map[string]string)
-					jsonStr, err := json.Marshal(row)
-					if err != nil {
-						panic(fmt.Errorf("CreateKafkaMessage: json marshal failed %w", err))
-					}
+				topic, ok, err := kafkaStage.topic(fileRow)
+				if err != nil {
+					sendResult(kafkaStage.errorMessage(fileRow.FileName(), wrapError(err), fileRow.GetAck()))
+					break
+				}
+				if !ok {
+					// dropped by the routing
+					fileRow.GetAck().Ack()
+					break
+				}
 
+				value, err := kafkaStage.serialize(ctx, topic, fileRow)
+				if errors.Is(err, ErrTerminal) {
 					sendResult(&kafkaMessage{
-						msg: &kafka.Message{
-							Topic: kafkaStage.valueTopic,
-							Key:   []byte(fileRow.FileName()),
-							Value: jsonStr,
-						},
+						err: err,
+						ack: fileRow.GetAck(),
 					})
+					break
+				}
+				if err != nil {
+					// the row is acked once its error is published
+					sendResult(kafkaStage.errorMessage(fileRow.FileName(), wrapError(err), fileRow.GetAck()))
+					break
+				}
 
+				key, err := kafkaStage.messageKey(fileRow)
+				if err != nil {
+					sendResult(kafkaStage.errorMessage(fileRow.FileName(), wrapError(err), fileRow.GetAck()))
+					break
 				}
 
-				if fileRow.GetOnDone() != nil {
-					f := *fileRow.GetOnDone()
-					f()
+				msg := &kafka.Message{
+					Topic:   topic,
+					Key:     key,
+					Value:   value,
+					Headers: kafkaStage.headers.headers(fileRow, value),
+				}
+				if err := kafkaStage.checkSize(msg); err != nil {
+					sendResult(kafkaStage.errorMessage(fileRow.FileName(), wrapError(err), fileRow.GetAck()))
+					break
 				}
 
+				sendResult(&kafkaMessage{
+					msg: msg,
+					ack: fileRow.GetAck(),
+				})
+
 			}
 		}
 
@@ -116,14 +138,76 @@ func (kafkaStage *kafkaStage) CreateMessage(ctx context.Context, fileRowCh chan
 	return resultCh
 }
 
+// topic returns the topic of the message of fileRow, the value topic unless
+// the stage was configured with a KafkaRouting. ok is false when the row is
+// dropped.
+func (kafkaStage *kafkaStage) topic(fileRow FileRow) (topic string, ok bool, err error) {
+	if kafkaStage.router == nil {
+		return kafkaStage.valueTopic, true, nil
+	}
+	return kafkaStage.router.topic(fileRow)
+}
+
+// serialize returns the value of the message of fileRow, its JSON unless
+// the stage was configured to write Avro.
+func (kafkaStage *kafkaStage) serialize(ctx context.Context, topic string, fileRow FileRow) ([]byte, error) {
+	if kafkaStage.serializer == nil {
+		return jsonSerializer{}.Serialize(ctx, topic, fileRow)
+	}
+	return kafkaStage.serializer.Serialize(ctx, topic, fileRow)
+}
+
+// messageKey returns the key of the message of fileRow, its file name
+// unless the stage was configured with a KafkaKey.
+func (kafkaStage *kafkaStage) messageKey(fileRow FileRow) ([]byte, error) {
+	if kafkaStage.key == nil {
+		return fileNameKey(fileRow)
+	}
+	return kafkaStage.key(fileRow)
+}
+
+// checkSize fails a message the writer would reject, or the brokers.
+func (kafkaStage *kafkaStage) checkSize(msg *kafka.Message) error {
+	if kafkaStage.maxMessageBytes <= 0 {
+		return nil
+	}
+	if size := messageSize(*msg) + messageOverhead; size > kafkaStage.maxMessageBytes {
+		return fmt.Errorf("CreateKafkaMessage: message of %d bytes for %v is larger than %d bytes", size, msg.Topic, kafkaStage.maxMessageBytes)
+	}
+	return nil
+}
+
+// errorMessage returns the message of err for the error topic, the JSON of
+// an AppError or the plain error text.
+func (kafkaStage *kafkaStage) errorMessage(fileName string, err error, ack *Acker) *kafkaMessage {
+
+	value := []byte(err.Error())
+
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		if data, jsonErr := appErr.toJSON(); jsonErr == nil {
+			value = data
+		}
+	}
+
+	return &kafkaMessage{
+		msg: &kafka.Message{
+			Topic: kafkaStage.errorTopic,
+			Key:   []byte(fileName),
+			Value: value,
+		},
+		ack: ack,
+	}
+}
+
 type kafkaMessage struct {
-	msg  *kafka.Message
-	done *func()
-	err  error
+	msg *kafka.Message
+	ack *Acker
+	err error
 }
 
-func (km *kafkaMessage) GetOnDone() *func() {
-	return km.done
+func (km *kafkaMessage) GetAck() *Acker {
+	return km.ack
 }
 
 func (km *kafkaMessage) Message() *kafka.Message {
@@ -134,6 +218,8 @@ func (km *kafkaMessage) GetError() error {
 	return km.err
 }
 
+// SendMessage batches and writes the messages, and emits a DeliveryReport
+// for every one of them along with the upstream errors.
 func (ks *kafkaStage) SendMessage(ctx context.Context, kafkaMessageCh chan KafkaMessageInt) chan GenericEventInt {
 
 	resultCh := make(chan GenericEventInt)
@@ -142,7 +228,7 @@ func (ks *kafkaStage) SendMessage(ctx context.Context, kafkaMessageCh chan Kafka
 		defer close(resultCh)
 		defer fmt.Println("sendToKafka closing...")
 
-		sendResult := func(r *GenericEvent) {
+		sendResult := func(r GenericEventInt) {
 			select {
 			case <-ctx.Done():
 				return
@@ -151,16 +237,28 @@ func (ks *kafkaStage) SendMessage(ctx context.Context, kafkaMessageCh chan Kafka
 
 		}
 
+		// linger is armed by the first message of a batch
+		var lingerTimer *time.Timer
+		var linger <-chan time.Time
+		flush := func(reason string) {
+			if lingerTimer != nil {
+				lingerTimer.Stop()
+				lingerTimer, linger = nil, nil
+			}
+			ks.sendBatch(ctx, reason, sendResult)
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-linger:
+				lingerTimer, linger = nil, nil
+				ks.sendBatch(ctx, FlushLinger, sendResult)
 			case kafkaMSG, ok := <-kafkaMessageCh:
 
 				if !ok {
-					if err := ks.messageBatcher.send(ctx); err != nil {
-						panic(err)
-					}
+					flush(FlushClose)
 					return
 				}
 
@@ -168,20 +266,24 @@ func (ks *kafkaStage) SendMessage(ctx context.Context, kafkaMessageCh chan Kafka
 					sendResult(&GenericEvent{
 						Err: kafkaMSG.GetError(),
 					})
+					kafkaMSG.GetAck().Nack(kafkaMSG.GetError())
 					break
 				}
 
-				ks.messageBatcher.add(*kafkaMSG.Message())
-				if ks.messageBatcher.size() >= 100 {
-					if err := ks.messageBatcher.send(ctx); err != nil {
-						panic(err)
-					}
-					ks.messageBatcher.flush()
+				msg := *kafkaMSG.Message()
+				if ks.messageBatcher.size() > 0 && ks.messageBatcher.bytes+messageSize(msg) > ks.messageBatcher.maxBytes {
+					flush(FlushBytes)
 				}
 
-				if kafkaMSG.GetOnDone() != nil {
-					f := *kafkaMSG.GetOnDone()
-					f()
+				ks.messageBatcher.add(msg, kafkaMSG.GetAck())
+				switch {
+				case ks.messageBatcher.size() >= ks.messageBatcher.maxCount:
+					flush(FlushCount)
+				case ks.messageBatcher.bytes >= ks.messageBatcher.maxBytes:
+					flush(FlushBytes)
+				case ks.messageBatcher.size() == 1:
+					lingerTimer = time.NewTimer(ks.messageBatcher.linger)
+					linger = lingerTimer.C
 				}
 
 			}
@@ -191,71 +293,323 @@ func (ks *kafkaStage) SendMessage(ctx context.Context, kafkaMessageCh chan Kafka
 	return resultCh
 }
 
-func kafkaClient() (*kafka.Writer, error) {
+// sendBatch writes the batched messages and sends a delivery report for
+// every one of them. A message the writer failed to write, once it exhausted
+// its own retries, is reported with a terminal error, unless it was too large
+// to be written at all, which only fails its row.
+func (ks *kafkaStage) sendBatch(ctx context.Context, reason string, sendResult func(GenericEventInt)) {
 
-	username, exist := os.LookupEnv("KAFKA_USERNAME")
-	if !exist {
-		panic(fmt.Errorf("sendToKafka: KAFKA_USERNAME is empty "))
-	}
+	reports := ks.messageBatcher.send(ctx, reason)
+	ks.messageBatcher.flush()
 
-	password, exist := os.LookupEnv("KAFKA_PASSWORD")
-	if !exist {
-		panic(fmt.Errorf("sendToKafka: KAFKA_PASSWORD is empty "))
+	for _, report := range reports {
+		if report.Err != nil {
+			err := fmt.Errorf("sendToKafka: failed to write message %w", report.Err)
+			if ctx.Err() == nil && !isMessageTooLarge(report.Err) {
+				err = terminal(err)
+			}
+			report.Err = err
+		}
+		sendResult(report)
 	}
+}
+
+// isMessageTooLarge tells the errors of a message the writer or a broker
+// rejected for its size.
+func isMessageTooLarge(err error) bool {
+	var tooLarge kafka.MessageTooLargeError
+	return errors.As(err, &tooLarge) || errors.Is(err, kafka.MessageSizeTooLarge)
+}
 
-	brokers, exist := os.LookupEnv("KAFKA_BROKERS")
-	if !exist {
-		panic(fmt.Errorf("sendToKafka: KAFKA_BROKERS is empty "))
+func NewMessageBatcher(cnf KafkaConfig) (*messageBatcher, error) {
+	client, err := newKafkaWriter(cnf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client %w", err)
 	}
 
-	dialer := &kafka.Dialer{
-		Timeout:   10 * time.Second,
-		DualStack: true,
-		SASLMechanism: plain.Mechanism{
-			Username: username,
-			Password: password,
-		},
-		TLS: &tls.Config{
-			InsecureSkipVerify: true,
+	return newMessageBatcher(newDeliveryWriter(client), cnf), nil
+}
+
+func newMessageBatcher(client messageWriter, cnf KafkaConfig) *messageBatcher {
+	cnf = cnf.withDefaults()
+	return &messageBatcher{
+		kafkaClient: client,
+		linger:      cnf.Linger,
+		maxCount:    cnf.BatchCount,
+		maxBytes:    cnf.BatchBytes,
+		stats: FlushStats{
+			Flushes: make(map[string]int),
 		},
 	}
+}
+
+// messageWriter writes a batch and reports, in the order of msgs, whether
+// every message was written.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) []*DeliveryReport
+}
+
+// DeliveryReport is the event SendMessage emits for every message once the
+// writer wrote it, or failed to. Partition and Offset are -1 when the
+// message was not written.
+type DeliveryReport struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Err       error
+}
+
+func (dr *DeliveryReport) GetError() error {
+	return dr.Err
+}
+
+// GetAck returns nil, the message is already resolved when it is reported.
+func (dr *DeliveryReport) GetAck() *Acker {
+	return nil
+}
+
+// kafkaWriter reports the partition and offset of the messages a
+// kafka.Writer wrote, which it only passes to its Completion function.
+type kafkaWriter struct {
+	writer *kafka.Writer
 
-	return kafka.NewWriter(kafka.WriterConfig{
-		Brokers:   strings.Split(brokers, ","),
-		BatchSize: 100,
-		Balancer:  &kafka.Hash{},
-		Dialer:    dialer,
-	}), nil
+	mu      sync.Mutex
+	written []kafka.Message
 }
 
-func NewMessageBatcher() *messageBatcher {
-	client, err := kafkaClient()
+func newDeliveryWriter(writer *kafka.Writer) *kafkaWriter {
+	kw := &kafkaWriter{writer: writer}
+	writer.Completion = kw.complete
+	return kw
+}
+
+// complete is called by the writer for every batch it wrote to a partition,
+// before WriteMessages returns.
+func (kw *kafkaWriter) complete(msgs []kafka.Message, err error) {
 	if err != nil {
-		panic(fmt.Errorf("failed to create kafka client %w", err))
+		return
 	}
+	kw.mu.Lock()
+	kw.written = append(kw.written, msgs...)
+	kw.mu.Unlock()
+}
 
-	return &messageBatcher{
-		kafkaClient: client,
+// WriteMessages fails a message above the BatchBytes of the writer alone,
+// the writer would fail every message of the call for it.
+func (kw *kafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) []*DeliveryReport {
+
+	maxBytes := kw.writer.BatchBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultKafkaMaxMessageBytes
 	}
+
+	fit := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if writerSize(m) <= maxBytes {
+			fit = append(fit, m)
+		}
+	}
+	if len(fit) == len(msgs) {
+		return kw.write(ctx, msgs)
+	}
+
+	fitReports := kw.write(ctx, fit)
+	reports := make([]*DeliveryReport, len(msgs))
+	for i, m := range msgs {
+		if writerSize(m) <= maxBytes {
+			reports[i], fitReports = fitReports[0], fitReports[1:]
+			continue
+		}
+		reports[i] = &DeliveryReport{
+			Topic:     m.Topic,
+			Partition: -1,
+			Offset:    -1,
+			Key:       m.Key,
+			Err:       kafka.MessageTooLargeError{Message: m},
+		}
+	}
+	return reports
+}
+
+func (kw *kafkaWriter) write(ctx context.Context, msgs []kafka.Message) []*DeliveryReport {
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	kw.mu.Lock()
+	kw.written = nil
+	kw.mu.Unlock()
+
+	err := kw.writer.WriteMessages(ctx, msgs...)
+
+	kw.mu.Lock()
+	written := kw.written
+	kw.written = nil
+	kw.mu.Unlock()
+
+	return deliveryReports(msgs, written, err)
+}
+
+// deliveryReports reports msgs as failed with err, or with the error of
+// each message when err is a kafka.WriteErrors, and sets the partition and
+// offset of the written ones. The written messages are copies, they are
+// matched to msgs by key and value in order, identical messages being
+// interchangeable.
+func deliveryReports(msgs []kafka.Message, written []kafka.Message, err error) []*DeliveryReport {
+
+	writeErrs, perMessage := err.(kafka.WriteErrors)
+
+	reports := make([]*DeliveryReport, len(msgs))
+	pending := make(map[string][]int)
+	for i, m := range msgs {
+		report := &DeliveryReport{
+			Topic:     m.Topic,
+			Partition: -1,
+			Offset:    -1,
+			Key:       m.Key,
+			Err:       err,
+		}
+		if perMessage {
+			report.Err = writeErrs[i]
+		}
+		reports[i] = report
+
+		if report.Err == nil {
+			id := string(m.Key) + "\x00" + string(m.Value)
+			pending[id] = append(pending[id], i)
+		}
+	}
+
+	for _, m := range written {
+		id := string(m.Key) + "\x00" + string(m.Value)
+		if len(pending[id]) == 0 {
+			continue
+		}
+		report := reports[pending[id][0]]
+		pending[id] = pending[id][1:]
+
+		report.Topic = m.Topic
+		report.Partition = m.Partition
+		report.Offset = m.Offset
+	}
+
+	return reports
+}
+
+// The reasons a batch is written for.
+const (
+	FlushLinger = "linger"
+	FlushCount  = "count"
+	FlushBytes  = "bytes"
+	FlushClose  = "close"
+)
+
+// FlushStats counts the batches written by the kafka stage.
+type FlushStats struct {
+	// Flushes counts the batches by the reason they were written for:
+	// FlushLinger, FlushCount, FlushBytes or FlushClose.
+	Flushes  map[string]int
+	Messages int
+	Bytes    int
+	// Delivered counts the messages the writer reported as written, out of
+	// the Messages batched.
+	Delivered int
+	// Failures counts the batches the writer failed to write a message of.
+	Failures int
 }
 
 type messageBatcher struct {
-	kafkaClient *kafka.Writer
-	messages    []kafka.Message
+	kafkaClient messageWriter
+	linger      time.Duration
+	maxCount    int
+	maxBytes    int
+
+	messages []kafka.Message
+	acks     []*Acker
+	bytes    int
+
+	mu    sync.Mutex
+	stats FlushStats
+}
+
+// messageOverhead is the framing kafka.Writer adds to the key and value of
+// a message when it checks its size.
+const messageOverhead = 22
+
+// writerSize is the size kafka.Writer checks against its BatchBytes.
+func writerSize(m kafka.Message) int64 {
+	return int64(messageOverhead + len(m.Key) + len(m.Value))
+}
+
+// messageSize approximates the bytes a message weighs in a batch.
+func messageSize(m kafka.Message) int {
+	size := len(m.Key) + len(m.Value)
+	for _, h := range m.Headers {
+		size += len(h.Key) + len(h.Value)
+	}
+	return size
+}
+
+// Stats returns the counters of the batches written so far.
+func (mb *messageBatcher) Stats() FlushStats {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stats := mb.stats
+	stats.Flushes = make(map[string]int, len(mb.stats.Flushes))
+	for reason, n := range mb.stats.Flushes {
+		stats.Flushes[reason] = n
+	}
+	return stats
 }
 
 func (mb *messageBatcher) size() int {
 	return len(mb.messages)
 }
 
-func (mb *messageBatcher) add(m kafka.Message) {
+func (mb *messageBatcher) add(m kafka.Message, ack *Acker) {
 	mb.messages = append(mb.messages, m)
+	mb.acks = append(mb.acks, ack)
+	mb.bytes += messageSize(m)
 }
 
 func (mb *messageBatcher) flush() {
 	mb.messages = make([]kafka.Message, 0)
+	mb.acks = make([]*Acker, 0)
+	mb.bytes = 0
 }
 
-func (mb *messageBatcher) send(ctx context.Context) error {
-	return mb.kafkaClient.WriteMessages(ctx, mb.messages...)
+// send writes the batched messages, resolves their ackers and returns their
+// delivery reports: a message is acked only once the writer reports it as
+// written. reason is recorded in the stats.
+func (mb *messageBatcher) send(ctx context.Context, reason string) []*DeliveryReport {
+	if len(mb.messages) == 0 {
+		return nil
+	}
+
+	reports := mb.kafkaClient.WriteMessages(ctx, mb.messages...)
+
+	delivered := 0
+	for i, report := range reports {
+		if report.Err != nil {
+			mb.acks[i].Nack(report.Err)
+			continue
+		}
+		delivered++
+		mb.acks[i].Ack()
+	}
+
+	mb.mu.Lock()
+	mb.stats.Flushes[reason]++
+	mb.stats.Messages += len(mb.messages)
+	mb.stats.Bytes += mb.bytes
+	mb.stats.Delivered += delivered
+	if delivered < len(mb.messages) {
+		mb.stats.Failures++
+	}
+	mb.mu.Unlock()
+
+	return reports
 }
@@ -3,8 +3,10 @@ package pipeline
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,6 +27,7 @@ func TestCreateMessage(t *testing.T) {
 	cases := []struct {
 		topic      string
 		errorTopic string
+		maxBytes   int
 		input      FileRow
 		expect     KafkaMessageInt
 	}{
@@ -36,11 +39,11 @@ func TestCreateMessage(t *testing.T) {
 					"family": "yousefi",
 				},
 				fileName: "test.csv",
-				done:     nil,
+				ack:      nil,
 			},
 			expect: &kafkaMessage{
-				err:  nil,
-				done: nil,
+				err: nil,
+				ack: nil,
 				msg: &kafka.Message{
 					Key:   []byte("test.csv"),
 					Value: []byte(jsonStr),
@@ -48,16 +51,44 @@ func TestCreateMessage(t *testing.T) {
 				},
 			},
 		},
+		{
+			topic: "value",
+			input: &csvRow{
+				data:     []string{"payam", "yousefi"},
+				fileName: "test.csv",
+			},
+			expect: &kafkaMessage{
+				msg: &kafka.Message{
+					Key:   []byte("test.csv"),
+					Value: []byte(`["payam","yousefi"]`),
+					Topic: "value",
+				},
+			},
+		},
+		{
+			errorTopic: "error",
+			input: &csvRow{
+				data:     map[string]interface{}{"value": func() {}},
+				fileName: "test.csv",
+			},
+			expect: &kafkaMessage{
+				msg: &kafka.Message{
+					Topic: "error",
+					Key:   []byte("test.csv"),
+					Value: []byte(`{"message":"CreateKafkaMessage: json marshal failed json: unsupported type: func()","meta":{}}`),
+				},
+			},
+		},
 		{
 			errorTopic: "error",
 			input: &csvRow{
 				err:      fmt.Errorf("errorMSG"),
 				fileName: "test.csv",
-				done:     nil,
+				ack:      nil,
 			},
 			expect: &kafkaMessage{
-				err:  nil,
-				done: nil,
+				err: nil,
+				ack: nil,
 				msg: &kafka.Message{
 					Topic: "error",
 					Key:   []byte("test.csv"),
@@ -65,13 +96,31 @@ func TestCreateMessage(t *testing.T) {
 				},
 			},
 		},
+		{
+			// the key, value and framing weigh 8+16+22 bytes
+			topic:      "value",
+			errorTopic: "error",
+			maxBytes:   45,
+			input: &csvRow{
+				data:     map[string]string{"name": "payam"},
+				fileName: "test.csv",
+			},
+			expect: &kafkaMessage{
+				msg: &kafka.Message{
+					Topic: "error",
+					Key:   []byte("test.csv"),
+					Value: []byte(`{"message":"CreateKafkaMessage: message of 46 bytes for value is larger than 45 bytes","meta":{}}`),
+				},
+			},
+		},
 	}
 
 	for i, c := range cases {
 
 		ks := &kafkaStage{
-			errorTopic: c.errorTopic,
-			valueTopic: c.topic,
+			errorTopic:      c.errorTopic,
+			valueTopic:      c.topic,
+			maxMessageBytes: c.maxBytes,
 		}
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -102,3 +151,314 @@ func TestCreateMessage(t *testing.T) {
 
 	}
 }
+
+type writerMock struct {
+	err error
+	// maxBytes fails the larger messages as kafkaWriter does, 1MB when
+	// zero.
+	maxBytes int64
+	mu       sync.Mutex
+	messages []kafka.Message
+	batches  []int
+}
+
+// WriteMessages writes msgs to partition 0, or fails them with err.
+func (m *writerMock) WriteMessages(ctx context.Context, msgs ...kafka.Message) []*DeliveryReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	maxBytes := m.maxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultKafkaMaxMessageBytes
+	}
+
+	err := m.err
+	if err == nil {
+		// a larger message fails alone, as with kafkaWriter
+		var tooLarge kafka.WriteErrors
+		for i, msg := range msgs {
+			if writerSize(msg) > maxBytes {
+				if tooLarge == nil {
+					tooLarge = make(kafka.WriteErrors, len(msgs))
+				}
+				tooLarge[i] = kafka.MessageTooLargeError{Message: msg}
+			}
+		}
+		if tooLarge != nil {
+			err = tooLarge
+		}
+	}
+
+	var written []kafka.Message
+	for i, msg := range msgs {
+		if failed, ok := err.(kafka.WriteErrors); err != nil && (!ok || failed[i] != nil) {
+			continue
+		}
+		msg.Offset = int64(len(m.messages))
+		m.messages = append(m.messages, msg)
+		written = append(written, msg)
+	}
+	m.batches = append(m.batches, len(msgs))
+
+	return deliveryReports(msgs, written, err)
+}
+
+func (m *writerMock) written() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int(nil), m.batches...)
+}
+
+func TestSendMessage(t *testing.T) {
+
+	brokerErr := errors.New("broker unavailable")
+
+	cases := []struct {
+		writeErr      error
+		expectOffsets []int64
+		expectFailed  []bool
+		expectAck     bool
+	}{
+		{
+			writeErr:      nil,
+			expectOffsets: []int64{0, 1},
+			expectFailed:  []bool{false, false},
+			expectAck:     true,
+		},
+		{
+			writeErr:      brokerErr,
+			expectOffsets: []int64{-1, -1},
+			expectFailed:  []bool{true, true},
+		},
+		{
+			writeErr:      kafka.WriteErrors{nil, brokerErr},
+			expectOffsets: []int64{0, -1},
+			expectFailed:  []bool{false, true},
+		},
+	}
+
+	for i, c := range cases {
+		writer := &writerMock{err: c.writeErr}
+		ks := &kafkaStage{
+			messageBatcher: newMessageBatcher(writer, KafkaConfig{}),
+		}
+
+		acked, nacked := 0, 0
+		root := NewAcker(func() { acked++ }, func(error) { nacked++ })
+
+		messageCh := make(chan KafkaMessageInt, 2)
+		messageCh <- &kafkaMessage{msg: &kafka.Message{Topic: "value", Key: []byte("a"), Value: []byte("1")}, ack: root.Derive()}
+		messageCh <- &kafkaMessage{msg: &kafka.Message{Topic: "value", Key: []byte("b"), Value: []byte("2")}, ack: root.Derive()}
+		root.Ack()
+		close(messageCh)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		var events []GenericEventInt
+		for event := range ks.SendMessage(ctx, messageCh) {
+			events = append(events, event)
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("case (%d) test timedout", i)
+		}
+		cancel()
+
+		if len(events) != 2 {
+			t.Fatalf("case (%d) expecting 2 delivery reports got %v", i, events)
+		}
+		for j, event := range events {
+			report, ok := event.(*DeliveryReport)
+			if !ok {
+				t.Fatalf("case (%d) expecting a delivery report got %T", i, event)
+			}
+			if report.Topic != "value" || string(report.Key) != []string{"a", "b"}[j] || report.Offset != c.expectOffsets[j] {
+				t.Fatalf("case (%d) unexpected report %d %+v", i, j, report)
+			}
+			failed := report.GetError() != nil
+			if failed != c.expectFailed[j] {
+				t.Fatalf("case (%d) expecting report %d failed %v got %v", i, j, c.expectFailed[j], report.GetError())
+			}
+			if failed && (!errors.Is(report.GetError(), ErrTerminal) || !errors.Is(report.GetError(), brokerErr)) {
+				t.Fatalf("case (%d) expecting a terminal error got %v", i, report.GetError())
+			}
+		}
+
+		if c.expectAck != (acked == 1) || c.expectAck == (nacked == 1) {
+			t.Fatalf("case (%d) expecting ack %v got %d acks %d nacks", i, c.expectAck, acked, nacked)
+		}
+		delivered := 0
+		for _, failed := range c.expectFailed {
+			if !failed {
+				delivered++
+			}
+		}
+		if stats := ks.Stats(); stats.Messages != 2 || stats.Delivered != delivered {
+			t.Fatalf("case (%d) expecting %d delivered messages got %+v", i, delivered, stats)
+		}
+	}
+}
+
+func TestDeliveryReports(t *testing.T) {
+
+	msgs := []kafka.Message{
+		{Topic: "value", Key: []byte("a"), Value: []byte("1")},
+		{Topic: "value", Key: []byte("b"), Value: []byte("1")},
+		{Topic: "value", Key: []byte("a"), Value: []byte("1")},
+	}
+	// the writer completes the batches of each partition in its own order
+	written := []kafka.Message{
+		{Topic: "value", Partition: 1, Offset: 7, Key: []byte("b"), Value: []byte("1")},
+		{Topic: "value", Partition: 0, Offset: 3, Key: []byte("a"), Value: []byte("1")},
+		{Topic: "value", Partition: 0, Offset: 4, Key: []byte("a"), Value: []byte("1")},
+	}
+
+	reports := deliveryReports(msgs, written, nil)
+	expect := [][2]int64{{0, 3}, {1, 7}, {0, 4}}
+	for i, report := range reports {
+		if report.Err != nil || int64(report.Partition) != expect[i][0] || report.Offset != expect[i][1] {
+			t.Fatalf("case (%d) expecting partition %d offset %d got %+v", i, expect[i][0], expect[i][1], report)
+		}
+	}
+
+	// the failed messages are not matched to written ones
+	err := kafka.WriteErrors{errors.New("failed"), nil, nil}
+	reports = deliveryReports(msgs, written[:2], err)
+	if reports[0].Err == nil || reports[0].Offset != -1 || reports[2].Offset != 3 || reports[1].Offset != 7 {
+		t.Fatalf("unexpected reports %+v %+v %+v", reports[0], reports[1], reports[2])
+	}
+}
+
+func TestKafkaWriterTooLarge(t *testing.T) {
+
+	// nothing listens on the address, the writer fails what it writes
+	kw := newDeliveryWriter(&kafka.Writer{
+		Addr:        kafka.TCP("127.0.0.1:1"),
+		BatchBytes:  40,
+		MaxAttempts: 1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reports := kw.WriteMessages(ctx,
+		kafka.Message{Topic: "value", Key: []byte("a"), Value: []byte("1")},
+		kafka.Message{Topic: "value", Key: []byte("b"), Value: []byte("12345678901234567890")},
+	)
+
+	if len(reports) != 2 {
+		t.Fatalf("expecting 2 reports got %v", reports)
+	}
+	if string(reports[1].Key) != "b" || !isMessageTooLarge(reports[1].Err) {
+		t.Fatalf("expecting b to be too large got %+v", reports[1])
+	}
+	if string(reports[0].Key) != "a" || reports[0].Err == nil || isMessageTooLarge(reports[0].Err) {
+		t.Fatalf("expecting a to be written alone got %+v", reports[0])
+	}
+}
+
+func TestSendMessageFlush(t *testing.T) {
+
+	cases := []struct {
+		cnf            KafkaConfig
+		values         []string
+		expectBatches  []int
+		expectFlushes  map[string]int
+		expectTooLarge int
+	}{
+		{
+			cnf:           KafkaConfig{BatchCount: 2, Linger: time.Hour},
+			values:        []string{"1", "2", "3", "4", "5"},
+			expectBatches: []int{2, 2, 1},
+			expectFlushes: map[string]int{FlushCount: 2, FlushClose: 1},
+		},
+		{
+			// a message larger than the limit is written alone
+			cnf:           KafkaConfig{BatchBytes: 10, Linger: time.Hour},
+			values:        []string{"1234", "5678", "901", "12345678901", "1"},
+			expectBatches: []int{2, 1, 1, 1},
+			expectFlushes: map[string]int{FlushBytes: 3, FlushClose: 1},
+		},
+		{
+			// a message above MaxMessageBytes fails alone without
+			// stopping the stage
+			cnf:            KafkaConfig{BatchBytes: 10, MaxMessageBytes: 32, Linger: time.Hour},
+			values:         []string{"1", "12345678901", "2"},
+			expectBatches:  []int{1, 1, 1},
+			expectFlushes:  map[string]int{FlushBytes: 2, FlushClose: 1},
+			expectTooLarge: 1,
+		},
+	}
+
+	for i, c := range cases {
+		// the writer checks the messages against MaxMessageBytes as
+		// newKafkaWriter configures it
+		writer := &writerMock{maxBytes: int64(c.cnf.withDefaults().MaxMessageBytes)}
+		ks := &kafkaStage{
+			messageBatcher: newMessageBatcher(writer, c.cnf),
+		}
+
+		messageCh := make(chan KafkaMessageInt, len(c.values))
+		for _, v := range c.values {
+			messageCh <- &kafkaMessage{msg: &kafka.Message{Value: []byte(v)}}
+		}
+		close(messageCh)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		tooLarge := 0
+		for event := range ks.SendMessage(ctx, messageCh) {
+			if err := event.GetError(); err != nil {
+				if errors.Is(err, ErrTerminal) || !isMessageTooLarge(err) {
+					t.Fatalf("case (%d) unexpected error %v", i, err)
+				}
+				tooLarge++
+			}
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("case (%d) test timedout", i)
+		}
+		cancel()
+
+		if tooLarge != c.expectTooLarge {
+			t.Fatalf("case (%d) expecting %d messages too large got %d", i, c.expectTooLarge, tooLarge)
+		}
+		if batches := writer.written(); !reflect.DeepEqual(batches, c.expectBatches) {
+			t.Fatalf("case (%d) expecting batches %v got %v", i, c.expectBatches, batches)
+		}
+		stats := ks.Stats()
+		if !reflect.DeepEqual(stats.Flushes, c.expectFlushes) || stats.Messages != len(c.values) {
+			t.Fatalf("case (%d) expecting flushes %v got %+v", i, c.expectFlushes, stats)
+		}
+	}
+}
+
+func TestSendMessageLinger(t *testing.T) {
+
+	writer := &writerMock{}
+	ks := &kafkaStage{
+		messageBatcher: newMessageBatcher(writer, KafkaConfig{Linger: 20 * time.Millisecond}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messageCh := make(chan KafkaMessageInt)
+	go func() {
+		for range ks.SendMessage(ctx, messageCh) {
+		}
+	}()
+
+	acked := make(chan struct{})
+	messageCh <- &kafkaMessage{
+		msg: &kafka.Message{Value: []byte("1")},
+		ack: NewAcker(func() { close(acked) }, nil),
+	}
+
+	select {
+	case <-acked:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("expecting the partial batch to be written")
+	}
+	if batches := writer.written(); !reflect.DeepEqual(batches, []int{1}) {
+		t.Fatalf("expecting a batch of 1 got %v", batches)
+	}
+	if stats := ks.Stats(); stats.Flushes[FlushLinger] != 1 {
+		t.Fatalf("expecting a linger flush got %+v", stats)
+	}
+}
@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+)
+
+// NotificationDecoder turns the body of a queue message into the S3 records
+// it notifies about. A nil slice without error means the message carries
+// nothing to process.
+type NotificationDecoder interface {
+	Decode(body []byte) ([]Record, error)
+}
+
+// NewNotificationDecoder returns a decoder that detects raw S3 event
+// notifications, SNS envelopes and EventBridge events and ignores S3 test
+// events. When eventNames is not empty only the records whose event name
+// matches one of the patterns are kept, e.g. "ObjectCreated:*".
+func NewNotificationDecoder(eventNames ...string) *notificationDecoder {
+	return &notificationDecoder{
+		eventNames: eventNames,
+	}
+}
+
+type notificationDecoder struct {
+	eventNames []string
+}
+
+// envelope holds the fields used to tell the supported formats apart.
+type envelope struct {
+	// SNS
+	Type    string
+	Message string
+
+	// EventBridge
+	Source     string               `json:"source"`
+	DetailType string               `json:"detail-type"`
+	Time       time.Time            `json:"time"`
+	Detail     *eventBridgeS3Detail `json:"detail"`
+
+	// S3 test event
+	Event string
+
+	Records *[]Record
+}
+
+type eventBridgeS3Detail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key       string `json:"key"`
+		Size      int    `json:"size"`
+		VersionID string `json:"version-id"`
+		ETag      string `json:"etag"`
+		Sequencer string `json:"sequencer"`
+	} `json:"object"`
+	Reason string `json:"reason"`
+}
+
+func (d *notificationDecoder) Decode(body []byte) ([]Record, error) {
+
+	var env envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("decode: invalid notification %w", err)
+	}
+
+	var records []Record
+	switch {
+	case env.Type == "Notification" && env.Message != "":
+		return d.Decode([]byte(env.Message))
+
+	case env.Event == "s3:TestEvent":
+		return nil, nil
+
+	case env.Source == "aws.s3" && env.Detail != nil:
+		records = []Record{eventBridgeRecord(env)}
+
+	case env.Records != nil:
+		records = *env.Records
+		// S3 event notifications URL-encode the object keys
+		for i := range records {
+			key, err := url.QueryUnescape(records[i].S3Data.Object.Key)
+			if err != nil {
+				return nil, fmt.Errorf("decode: invalid object key %v %w", records[i].S3Data.Object.Key, err)
+			}
+			records[i].S3Data.Object.Key = key
+		}
+
+	default:
+		return nil, errors.New("decode: unknown notification format")
+	}
+
+	return d.filter(records)
+}
+
+func (d *notificationDecoder) filter(records []Record) ([]Record, error) {
+	if len(d.eventNames) == 0 {
+		return records, nil
+	}
+
+	var result []Record
+	for _, r := range records {
+		for _, pattern := range d.eventNames {
+			matched, err := path.Match(pattern, r.EventName)
+			if err != nil {
+				return nil, fmt.Errorf("decode: invalid event name pattern %v %w", pattern, err)
+			}
+			if matched {
+				result = append(result, r)
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// eventBridgeRecord maps an EventBridge S3 event to the record of the
+// equivalent S3 notification, "Object Created" with reason "PutObject"
+// becomes the event name "ObjectCreated:PutObject".
+func eventBridgeRecord(env envelope) Record {
+	eventName := env.DetailType
+	switch env.DetailType {
+	case "Object Created":
+		eventName = "ObjectCreated:" + env.Detail.Reason
+	case "Object Deleted":
+		eventName = "ObjectRemoved:" + env.Detail.Reason
+	}
+
+	return Record{
+		EventName: eventName,
+		EventTime: env.Time,
+		S3Data: S3{
+			Bucket: Bucket{
+				Name: env.Detail.Bucket.Name,
+			},
+			Object: Object{
+				Key:       env.Detail.Object.Key,
+				Size:      env.Detail.Object.Size,
+				VersionID: env.Detail.Object.VersionID,
+				ETag:      env.Detail.Object.ETag,
+				Sequencer: env.Detail.Object.Sequencer,
+			},
+		},
+	}
+}
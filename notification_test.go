@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const snsWrappedMSG string = `{"Type":"Notification","MessageId":"8f2c4b8e","TopicArn":"arn:aws:sns:eu-central-1:123456789012:uploads","Message":"{\"Records\":[{\"eventName\":\"ObjectCreated:Put\",\"s3\":{\"bucket\":{\"name\":\"pysf-kafka-to-s3\"},\"object\":{\"key\":\"sales.csv\",\"size\":42}}}]}"}`
+const eventBridgeMSG string = `{"version":"0","id":"17793124","detail-type":"Object Created","source":"aws.s3","account":"123456789012","time":"2022-04-28T15:02:12Z","region":"eu-central-1","detail":{"version":"0","bucket":{"name":"pysf-kafka-to-s3"},"object":{"key":"sales.csv","size":42,"etag":"b1946ac92492d2347c6235b4d2611184"},"reason":"PutObject"}}`
+const s3TestEventMSG string = `{"Service":"Amazon S3","Event":"s3:TestEvent","Time":"2022-04-28T15:02:12.748Z","Bucket":"pysf-kafka-to-s3","RequestId":"FHNYVGN3ZQ9QEK8P","HostId":"syNQ04Biev"}`
+const encodedKeyMSG string = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"pysf-kafka-to-s3"},"object":{"key":"2022/sales+report+%C3%BCber.csv","size":42,"versionId":"3HL4kqtJlcpXroDTDmJ","eTag":"b1946ac92492d2347c6235b4d2611184"}}}]}`
+const objectRemovedMSG string = `{"Records":[{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"pysf-kafka-to-s3"},"object":{"key":"sales.csv"}}}]}`
+
+func TestNotificationDecoder(t *testing.T) {
+
+	sales := S3{
+		Bucket: Bucket{Name: "pysf-kafka-to-s3"},
+		Object: Object{Key: "sales.csv", Size: 42},
+	}
+
+	cases := []struct {
+		body       string
+		eventNames []string
+		expect     []Record
+		expectErr  bool
+	}{
+		{
+			body: snsWrappedMSG,
+			expect: []Record{
+				{EventName: "ObjectCreated:Put", S3Data: sales},
+			},
+		},
+		{
+			body: eventBridgeMSG,
+			expect: []Record{
+				{
+					EventName: "ObjectCreated:PutObject",
+					EventTime: time.Date(2022, 4, 28, 15, 2, 12, 0, time.UTC),
+					S3Data: S3{
+						Bucket: Bucket{Name: "pysf-kafka-to-s3"},
+						Object: Object{Key: "sales.csv", Size: 42, ETag: "b1946ac92492d2347c6235b4d2611184"},
+					},
+				},
+			},
+		},
+		{
+			body: encodedKeyMSG,
+			expect: []Record{
+				{
+					EventName: "ObjectCreated:Put",
+					S3Data: S3{
+						Bucket: Bucket{Name: "pysf-kafka-to-s3"},
+						Object: Object{
+							Key:       "2022/sales report über.csv",
+							Size:      42,
+							VersionID: "3HL4kqtJlcpXroDTDmJ",
+							ETag:      "b1946ac92492d2347c6235b4d2611184",
+						},
+					},
+				},
+			},
+		},
+		{
+			body:   s3TestEventMSG,
+			expect: nil,
+		},
+		{
+			body:       objectRemovedMSG,
+			eventNames: []string{"ObjectCreated:*"},
+			expect:     nil,
+		},
+		{
+			body:       snsWrappedMSG,
+			eventNames: []string{"ObjectCreated:*"},
+			expect: []Record{
+				{EventName: "ObjectCreated:Put", S3Data: sales},
+			},
+		},
+		{
+			body:      `{"hello":"world"}`,
+			expectErr: true,
+		},
+		{
+			body:      `not json`,
+			expectErr: true,
+		},
+	}
+
+	for i, c := range cases {
+		records, err := NewNotificationDecoder(c.eventNames...).Decode([]byte(c.body))
+
+		if c.expectErr {
+			if err == nil {
+				t.Fatalf("case (%d) expecting an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case (%d) unexpected err %v", i, err)
+		}
+
+		if !reflect.DeepEqual(records, c.expect) {
+			got, _ := json.Marshal(records)
+			t.Fatalf("case (%d) expecting %v got %s", i, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrTerminal marks the errors a pipeline can not recover from, such as a
+// Kafka cluster refusing writes. errors.Is(err, ErrTerminal) tells them.
+var ErrTerminal = errors.New("pipeline: terminal error")
+
+type terminalError struct {
+	err error
+}
+
+// terminal marks err as an error the pipeline can not recover from.
+func terminal(err error) error {
+	return &terminalError{err: err}
+}
+
+func (e *terminalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
+func (e *terminalError) Is(target error) bool {
+	return target == ErrTerminal
+}
+
+// Run drains eventCh, the output of the last stage of a pipeline, until it
+// is closed and passes every error event to onError. On the first terminal
+// error it calls cancel so the stages wind down, and returns that error once
+// they did. It returns nil when the pipeline ends otherwise.
+func Run(cancel context.CancelFunc, eventCh chan GenericEventInt, onError func(error)) error {
+
+	var terminalErr error
+	for event := range eventCh {
+		err := event.GetError()
+		if err == nil {
+			continue
+		}
+
+		if onError != nil {
+			onError(err)
+		}
+		if terminalErr == nil && errors.Is(err, ErrTerminal) {
+			terminalErr = err
+			cancel()
+		}
+	}
+
+	return terminalErr
+}
+
+// lateErrors emits the errors of work ending after the output of a stage
+// may be closed, such as the actions run once a file resolves. An error
+// reported once the output is closed can only be logged.
+type lateErrors struct {
+	mu     sync.RWMutex
+	closed bool
+	send   func(error)
+}
+
+func newLateErrors(send func(error)) *lateErrors {
+	return &lateErrors{send: send}
+}
+
+func (le *lateErrors) report(err error) {
+	le.mu.RLock()
+	defer le.mu.RUnlock()
+	if le.closed {
+		fmt.Println(err)
+		return
+	}
+	le.send(err)
+}
+
+// close calls closeOutput once no report is being sent.
+func (le *lateErrors) close(closeOutput func()) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.closed = true
+	closeOutput()
+}
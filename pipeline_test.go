@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+
+	cases := []struct {
+		errs         []error
+		expectErr    error
+		expectCancel bool
+	}{
+		{
+			errs: []error{nil, fmt.Errorf("bad row")},
+		},
+		{
+			errs:         []error{fmt.Errorf("bad row"), terminal(fmt.Errorf("write failed")), terminal(fmt.Errorf("write failed again"))},
+			expectErr:    ErrTerminal,
+			expectCancel: true,
+		},
+	}
+
+	for i, c := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		eventCh := make(chan GenericEventInt)
+		go func() {
+			defer close(eventCh)
+			for _, err := range c.errs {
+				eventCh <- &GenericEvent{Err: err}
+			}
+		}()
+
+		var reported []error
+		err := Run(cancel, eventCh, func(err error) { reported = append(reported, err) })
+
+		if c.expectErr == nil && err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		if c.expectErr != nil && (!errors.Is(err, c.expectErr) || err.Error() != "write failed") {
+			t.Fatalf("case (%d) expecting the first terminal error got %v", i, err)
+		}
+
+		expectReported := 0
+		for _, err := range c.errs {
+			if err != nil {
+				expectReported++
+			}
+		}
+		if len(reported) != expectReported {
+			t.Fatalf("case (%d) expecting %d reported errors got %d", i, expectReported, len(reported))
+		}
+
+		select {
+		case <-ctx.Done():
+			if !c.expectCancel {
+				t.Fatalf("case (%d) unexpected cancellation", i)
+			}
+		case <-time.After(10 * time.Millisecond):
+			if c.expectCancel {
+				t.Fatalf("case (%d) expecting the pipeline to be cancelled", i)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestLateErrors(t *testing.T) {
+
+	errCh := make(chan error)
+	late := newLateErrors(func(err error) { errCh <- err })
+
+	go late.report(errors.New("move failed"))
+	select {
+	case err := <-errCh:
+		if err.Error() != "move failed" {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+
+	late.close(func() { close(errCh) })
+	// a report after close is not sent on the closed channel
+	late.report(errors.New("too late"))
+}
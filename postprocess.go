@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	statusTag = "pipeline-status"
+	rowsTag   = "pipeline-rows"
+)
+
+// PostAction is applied to a source object once every event read from it
+// is resolved. Tagging comes first so a moved object keeps its tags.
+type PostAction struct {
+	// Tag adds pipeline-status, done or failed, and pipeline-rows, the
+	// number of events read from the object, to the object tags.
+	Tag bool
+	// Tags are added to the object tags as well.
+	Tags map[string]string
+	// MoveTo copies the object under this prefix, e.g. "processed/", and
+	// deletes the original. Objects above 5GB can not be copied.
+	MoveTo string
+	// Delete removes the object.
+	Delete bool
+}
+
+func (a PostAction) empty() bool {
+	return !a.Tag && len(a.Tags) == 0 && a.MoveTo == "" && !a.Delete
+}
+
+// postProcess returns the acker of a file read from meta. Once it resolves
+// the matching action of the config is applied and then parent, the acker
+// of the notification, is resolved. A failing action nacks parent so the
+// object is processed again and its error goes to reportError. A failed
+// file handled by OnFailure acks parent, it would not be found again.
+func (stg s3Stage) postProcess(ctx context.Context, client *s3Client, meta ObjectMeta, parent *Acker, reportError func(error)) *Acker {
+
+	if stg.cnf.OnSuccess.empty() && stg.cnf.OnFailure.empty() {
+		return parent.Derive()
+	}
+
+	post := parent.Derive()
+	var fileAck *Acker
+	fileAck = NewAcker(func() {
+		go func() {
+			err := stg.applyAction(ctx, client, meta, stg.cnf.OnSuccess, "done", fileAck.Leaves())
+			if err != nil {
+				reportError(err)
+				post.Nack(err)
+				return
+			}
+			post.Ack()
+		}()
+	}, func(failure error) {
+		if stg.cnf.OnFailure.empty() {
+			post.Nack(failure)
+			return
+		}
+		go func() {
+			err := stg.applyAction(ctx, client, meta, stg.cnf.OnFailure, "failed", fileAck.Leaves())
+			if err != nil {
+				reportError(err)
+				post.Nack(err)
+				return
+			}
+			post.Ack()
+		}()
+	})
+
+	return fileAck
+}
+
+func (stg s3Stage) applyAction(ctx context.Context, client *s3Client, meta ObjectMeta, action PostAction, status string, rows int) error {
+
+	retry := func(fn func() error) error {
+		attempts, err := stg.cnf.Retry.do(ctx, isRetryableS3Error, fn)
+		if err != nil {
+			return withAttempts(err, attempts)
+		}
+		return nil
+	}
+
+	if action.Tag || len(action.Tags) > 0 {
+		tags := make(map[string]string, len(action.Tags)+2)
+		for k, v := range action.Tags {
+			tags[k] = v
+		}
+		if action.Tag {
+			tags[statusTag] = status
+			tags[rowsTag] = strconv.Itoa(rows)
+		}
+		if err := retry(func() error { return client.addTags(ctx, meta, tags) }); err != nil {
+			return wrapError(fmt.Errorf("postProcess: failed to tag %v %w", meta.Key, err))
+		}
+	}
+
+	if action.MoveTo != "" {
+		if err := retry(func() error { return client.copyObject(ctx, meta, action.MoveTo+meta.Key) }); err != nil {
+			return wrapError(fmt.Errorf("postProcess: failed to copy %v to %v %w", meta.Key, action.MoveTo, err))
+		}
+	}
+
+	if action.MoveTo != "" || action.Delete {
+		if err := retry(func() error { return client.deleteObject(ctx, meta) }); err != nil {
+			return wrapError(fmt.Errorf("postProcess: failed to delete %v %w", meta.Key, err))
+		}
+	}
+
+	return nil
+}
+
+// addTags merges tags into the tags of the object version of meta.
+func (s *s3Client) addTags(ctx context.Context, meta ObjectMeta, tags map[string]string) error {
+
+	getInput := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(meta.Bucket),
+		Key:    aws.String(meta.Key),
+	}
+	if meta.VersionID != "" {
+		getInput.VersionId = aws.String(meta.VersionID)
+	}
+	out, err := s.api.GetObjectTaggingWithContext(ctx, getInput)
+	if err != nil {
+		return err
+	}
+
+	tagSet := make([]*s3.Tag, 0, len(out.TagSet)+len(tags))
+	for _, tag := range out.TagSet {
+		if _, ok := tags[aws.StringValue(tag.Key)]; !ok {
+			tagSet = append(tagSet, tag)
+		}
+	}
+	for k, v := range tags {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	_, err = s.api.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:    getInput.Bucket,
+		Key:       getInput.Key,
+		VersionId: getInput.VersionId,
+		Tagging:   &s3.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// copyObject copies the object version of meta to key in the same bucket,
+// tags included.
+func (s *s3Client) copyObject(ctx context.Context, meta ObjectMeta, key string) error {
+
+	segments := strings.Split(meta.Key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	source := meta.Bucket + "/" + strings.Join(segments, "/")
+	if meta.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(meta.VersionID)
+	}
+
+	_, err := s.api.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(meta.Bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(source),
+	})
+	return err
+}
+
+// deleteObject deletes the object version of meta, so that a version
+// uploaded since the notification is kept.
+func (s *s3Client) deleteObject(ctx context.Context, meta ObjectMeta) error {
+
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(meta.Bucket),
+		Key:    aws.String(meta.Key),
+	}
+	if meta.VersionID != "" {
+		input.VersionId = aws.String(meta.VersionID)
+	}
+
+	_, err := s.api.DeleteObjectWithContext(ctx, input)
+	return err
+}
@@ -0,0 +1,228 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type postAPIMock struct {
+	s3APIMock
+	mu       sync.Mutex
+	calls    []string
+	tags     map[string]string
+	failCopy bool
+}
+
+func (m *postAPIMock) record(call string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, call)
+}
+
+func (m *postAPIMock) GetObjectTaggingWithContext(ctx aws.Context, in *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	m.record(fmt.Sprintf("GetObjectTagging %v", aws.StringValue(in.Key)))
+	return &s3.GetObjectTaggingOutput{
+		TagSet: []*s3.Tag{{Key: aws.String("owner"), Value: aws.String("ingest")}},
+	}, nil
+}
+
+func (m *postAPIMock) PutObjectTaggingWithContext(ctx aws.Context, in *s3.PutObjectTaggingInput, opts ...request.Option) (*s3.PutObjectTaggingOutput, error) {
+	m.record(fmt.Sprintf("PutObjectTagging %v", aws.StringValue(in.Key)))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tags = make(map[string]string)
+	for _, tag := range in.Tagging.TagSet {
+		m.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (m *postAPIMock) CopyObjectWithContext(ctx aws.Context, in *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	m.record(fmt.Sprintf("CopyObject %v %v", aws.StringValue(in.CopySource), aws.StringValue(in.Key)))
+	if m.failCopy {
+		return nil, awserr.New("AccessDenied", "denied", nil)
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *postAPIMock) DeleteObjectWithContext(ctx aws.Context, in *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	m.record(fmt.Sprintf("DeleteObject %v %v", aws.StringValue(in.Key), aws.StringValue(in.VersionId)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestPostProcess(t *testing.T) {
+
+	key := "in/a b.csv"
+
+	cases := []struct {
+		cnf         S3Config
+		failRow     bool
+		failCopy    bool
+		expectCalls []string
+		expectTags  map[string]string
+		expectNack  bool
+		// expectReport is set when the action fails
+		expectReport bool
+	}{
+		{
+			cnf: S3Config{
+				OnSuccess: PostAction{Tag: true, MoveTo: "processed/"},
+				OnFailure: PostAction{MoveTo: "failed/"},
+			},
+			expectCalls: []string{
+				"GetObjectTagging in/a b.csv",
+				"PutObjectTagging in/a b.csv",
+				"CopyObject bucket/in/a%20b.csv?versionId=v1 processed/in/a b.csv",
+				"DeleteObject in/a b.csv v1",
+			},
+			expectTags: map[string]string{
+				"owner":   "ingest",
+				statusTag: "done",
+				rowsTag:   "2",
+			},
+		},
+		{
+			cnf: S3Config{
+				OnSuccess: PostAction{MoveTo: "processed/"},
+				OnFailure: PostAction{MoveTo: "failed/"},
+			},
+			// the failed object is moved away so its notification is acked
+			failRow: true,
+			expectCalls: []string{
+				"CopyObject bucket/in/a%20b.csv?versionId=v1 failed/in/a b.csv",
+				"DeleteObject in/a b.csv v1",
+			},
+		},
+		{
+			cnf: S3Config{
+				OnFailure: PostAction{MoveTo: "failed/"},
+			},
+			failRow:  true,
+			failCopy: true,
+			expectCalls: []string{
+				"CopyObject bucket/in/a%20b.csv?versionId=v1 failed/in/a b.csv",
+			},
+			expectNack:   true,
+			expectReport: true,
+		},
+		{
+			// without OnFailure the object is processed again
+			cnf: S3Config{
+				OnSuccess: PostAction{MoveTo: "processed/"},
+			},
+			failRow:    true,
+			expectNack: true,
+		},
+		{
+			cnf: S3Config{
+				OnSuccess: PostAction{Tags: map[string]string{"stage": "landing"}, Delete: true},
+			},
+			expectCalls: []string{
+				"GetObjectTagging in/a b.csv",
+				"PutObjectTagging in/a b.csv",
+				"DeleteObject in/a b.csv v1",
+			},
+			expectTags: map[string]string{
+				"owner": "ingest",
+				"stage": "landing",
+			},
+		},
+		{
+			// the original is kept when the copy fails
+			cnf: S3Config{
+				OnSuccess: PostAction{MoveTo: "processed/"},
+			},
+			failCopy: true,
+			expectCalls: []string{
+				"CopyObject bucket/in/a%20b.csv?versionId=v1 processed/in/a b.csv",
+			},
+			expectNack:   true,
+			expectReport: true,
+		},
+		{
+			cnf: S3Config{},
+		},
+	}
+
+	for i, c := range cases {
+		api := &postAPIMock{
+			s3APIMock: s3APIMock{objects: map[string]string{key: "a\n1\n2\n"}},
+			failCopy:  c.failCopy,
+		}
+		c.cnf.Stream = true
+		c.cnf.Retry = RetryPolicy{MaxAttempts: 1}
+		stg := s3Stage{
+			client: s3Client{api: api},
+			cnf:    c.cnf,
+		}
+
+		resolved := make(chan error, 1)
+		notification := &SQSS3Event{
+			message: Record{
+				S3Data: S3{
+					Bucket: Bucket{Name: "bucket"},
+					Object: Object{Key: key, VersionID: "v1"},
+				},
+			},
+			ack: NewAcker(func() { resolved <- nil }, func(err error) { resolved <- err }),
+		}
+
+		reported := make(chan error, 1)
+		file := stg.fetchOne(context.Background(), notification, func(err error) { reported <- err })
+		if file.GetError() != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, file.GetError())
+		}
+		rows := []*Acker{file.GetAck().Derive(), file.GetAck().Derive()}
+		file.GetAck().Ack()
+		file.File().Close()
+
+		rows[0].Ack()
+		select {
+		case <-resolved:
+			t.Fatalf("case (%d) resolved before every row was", i)
+		default:
+		}
+		if c.failRow {
+			rows[1].Nack(errors.New("failed row"))
+		} else {
+			rows[1].Ack()
+		}
+
+		select {
+		case err := <-resolved:
+			if c.expectNack != (err != nil) {
+				t.Fatalf("case (%d) expecting nack %v got %v", i, c.expectNack, err)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("case (%d) test timedout", i)
+		}
+
+		select {
+		case err := <-reported:
+			if !c.expectReport {
+				t.Fatalf("case (%d) unexpected error %v", i, err)
+			}
+		default:
+			if c.expectReport {
+				t.Fatalf("case (%d) expecting the action error", i)
+			}
+		}
+
+		if !reflect.DeepEqual(api.calls, c.expectCalls) {
+			t.Fatalf("case (%d) expecting calls %q got %q", i, c.expectCalls, api.calls)
+		}
+		if !reflect.DeepEqual(api.tags, c.expectTags) {
+			t.Fatalf("case (%d) expecting tags %v got %v", i, c.expectTags, api.tags)
+		}
+	}
+}
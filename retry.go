@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = 200 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+)
+
+// RetryPolicy retries transient failures with exponential backoff and full
+// jitter, zero values are replaced by defaults.
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt, 1 disables retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	return p
+}
+
+// backoff returns a random delay in [0, min(MaxDelay, BaseDelay*2^attempt)).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 32 {
+		if d := p.BaseDelay << uint(attempt); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// do calls fn until it succeeds, fails with an error retryable rejects, the
+// attempts are exhausted or ctx is cancelled. It returns the number of
+// attempts made and the last error.
+func (p RetryPolicy) do(ctx context.Context, retryable func(error) bool, fn func() error) (int, error) {
+	p = p.withDefaults()
+
+	attempt := 0
+	for {
+		err := fn()
+		attempt++
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(p.backoff(attempt - 1)):
+		}
+	}
+}
+
+// withAttempts records the number of attempts in the AppError of err,
+// wrapping err in one when needed.
+func withAttempts(err error, attempts int) error {
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		appErr = wrapError(err)
+		err = appErr
+	}
+	appErr.Misc["attempts"] = attempts
+	return err
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+
+	cases := []struct {
+		failures       int
+		retryable      bool
+		expectAttempts int
+		expectErr      bool
+	}{
+		{failures: 0, retryable: true, expectAttempts: 1},
+		{failures: 2, retryable: true, expectAttempts: 3},
+		{failures: 5, retryable: true, expectAttempts: 4, expectErr: true},
+		{failures: 5, retryable: false, expectAttempts: 1, expectErr: true},
+	}
+
+	for i, c := range cases {
+		policy := RetryPolicy{
+			MaxAttempts: 4,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    2 * time.Millisecond,
+		}
+
+		calls := 0
+		attempts, err := policy.do(context.Background(), func(error) bool { return c.retryable }, func() error {
+			calls++
+			if calls <= c.failures {
+				return fmt.Errorf("failure %d", calls)
+			}
+			return nil
+		})
+
+		if attempts != c.expectAttempts || calls != c.expectAttempts {
+			t.Fatalf("case (%d) expecting %d attempts got %d (%d calls)", i, c.expectAttempts, attempts, calls)
+		}
+		if (err != nil) != c.expectErr {
+			t.Fatalf("case (%d) unexpected err %v", i, err)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+
+	policy := RetryPolicy{
+		BaseDelay: 10 * time.Millisecond,
+		MaxDelay:  50 * time.Millisecond,
+	}.withDefaults()
+
+	for attempt := 0; attempt < 40; attempt++ {
+		limit := 10 * time.Millisecond << uint(attempt)
+		if attempt >= 3 {
+			limit = 50 * time.Millisecond
+		}
+		if d := policy.backoff(attempt); d < 0 || d >= limit {
+			t.Fatalf("attempt %d: expecting a delay below %v got %v", attempt, limit, d)
+		}
+	}
+}
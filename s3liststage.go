@@ -0,0 +1,232 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3ListConfig selects the objects of a bucket the list stage emits.
+type S3ListConfig struct {
+	Bucket string
+	Prefix string
+	// StartAfter skips the keys up to and including StartAfter.
+	StartAfter string
+	// ModifiedSince skips the objects last modified before it.
+	ModifiedSince time.Time
+	// Pattern is a path.Match glob the keys must match, e.g.
+	// "logs/*/*.csv.gz". Empty matches every key.
+	Pattern string
+	// Interval scans the prefix again every Interval and only emits the
+	// objects not emitted before, a rewritten object included. 0 lists the
+	// prefix once.
+	Interval time.Duration
+	// PageSize is the number of keys per ListObjectsV2 call, 1000 by
+	// default.
+	PageSize int64
+}
+
+func NewS3ListStage(cnf S3ListConfig, awsCnf *aws.Config) s3ListStage {
+	conf := aws.NewConfig()
+	if awsCnf != nil {
+		conf = awsCnf.Copy()
+	}
+
+	return s3ListStage{
+		api: s3.New(session.Must(session.NewSession(conf))),
+		cnf: cnf,
+	}
+}
+
+type s3ListStage struct {
+	api s3iface.S3API
+	cnf S3ListConfig
+}
+
+// List emits a notification per listed object for s3Stage.Fetch. In
+// scheduled mode a nacked object is emitted again by the next scan.
+func (stg s3ListStage) List(ctx context.Context) chan S3Notification {
+
+	resultCh := make(chan S3Notification)
+
+	sendResult := func(r *S3ListEvent) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case resultCh <- r:
+			return true
+		}
+	}
+
+	go func() {
+		defer close(resultCh)
+		defer fmt.Println("S3 list closing")
+
+		seen := newSeenObjects()
+		for {
+			if err := stg.scan(ctx, seen, sendResult); err != nil && ctx.Err() == nil {
+				sendResult(&S3ListEvent{
+					err: err,
+				})
+			}
+			if stg.cnf.Interval <= 0 {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(stg.cnf.Interval):
+			}
+		}
+	}()
+
+	return resultCh
+}
+
+// scan lists the prefix once and emits the matching objects missing from
+// seen. Objects no longer listed are forgotten.
+func (stg s3ListStage) scan(ctx context.Context, seen *seenObjects, sendResult func(*S3ListEvent) bool) error {
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(stg.cnf.Bucket),
+	}
+	if stg.cnf.Prefix != "" {
+		input.Prefix = aws.String(stg.cnf.Prefix)
+	}
+	if stg.cnf.StartAfter != "" {
+		input.StartAfter = aws.String(stg.cnf.StartAfter)
+	}
+	if stg.cnf.PageSize > 0 {
+		input.MaxKeys = aws.Int64(stg.cnf.PageSize)
+	}
+
+	listed := make(map[string]bool)
+	err := stg.api.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			meta := ObjectMeta{
+				Bucket:    stg.cnf.Bucket,
+				Key:       aws.StringValue(object.Key),
+				ETag:      strings.Trim(aws.StringValue(object.ETag), `"`),
+				Size:      aws.Int64Value(object.Size),
+				EventTime: aws.TimeValue(object.LastModified),
+			}
+			if !stg.matches(meta) {
+				continue
+			}
+
+			id := meta.Key + "@" + meta.ETag
+			listed[id] = true
+			if !seen.add(id) {
+				continue
+			}
+
+			event := &S3ListEvent{
+				meta: meta,
+				ack:  NewAcker(nil, func(error) { seen.remove(id) }),
+			}
+			if !sendResult(event) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return wrapError(fmt.Errorf("list: failed to list %v/%v %w", stg.cnf.Bucket, stg.cnf.Prefix, err))
+	}
+	if ctx.Err() == nil {
+		seen.keep(listed)
+	}
+
+	return nil
+}
+
+func (stg s3ListStage) matches(meta ObjectMeta) bool {
+	if strings.HasSuffix(meta.Key, "/") {
+		return false
+	}
+	if !stg.cnf.ModifiedSince.IsZero() && meta.EventTime.Before(stg.cnf.ModifiedSince) {
+		return false
+	}
+	if stg.cnf.Pattern != "" {
+		if ok, _ := path.Match(stg.cnf.Pattern, meta.Key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// seenObjects holds the objects emitted by earlier scans, by key and etag.
+type seenObjects struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func newSeenObjects() *seenObjects {
+	return &seenObjects{
+		ids: make(map[string]bool),
+	}
+}
+
+// add returns false when id was already seen.
+func (s *seenObjects) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	return true
+}
+
+func (s *seenObjects) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, id)
+}
+
+// keep forgets the ids missing from listed.
+func (s *seenObjects) keep(listed map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.ids {
+		if !listed[id] {
+			delete(s.ids, id)
+		}
+	}
+}
+
+// S3ListEvent is an object found by the list stage.
+type S3ListEvent struct {
+	err  error
+	meta ObjectMeta
+	ack  *Acker
+}
+
+func (e *S3ListEvent) Bucket() string {
+	return e.meta.Bucket
+}
+
+func (e *S3ListEvent) Key() string {
+	return e.meta.Key
+}
+
+func (e *S3ListEvent) Meta() ObjectMeta {
+	return e.meta
+}
+
+func (e *S3ListEvent) GetAck() *Acker {
+	return e.ack
+}
+
+func (e *S3ListEvent) GetError() error {
+	return e.err
+}
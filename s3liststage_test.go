@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type listAPIMock struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	objects []*s3.Object
+}
+
+func (m *listAPIMock) set(objects ...*s3.Object) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects = objects
+}
+
+// ListObjectsV2PagesWithContext serves the objects after StartAfter under
+// Prefix, two per page.
+func (m *listAPIMock) ListObjectsV2PagesWithContext(ctx aws.Context, in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	m.mu.Lock()
+	var objects []*s3.Object
+	for _, object := range m.objects {
+		key := aws.StringValue(object.Key)
+		if strings.HasPrefix(key, aws.StringValue(in.Prefix)) && key > aws.StringValue(in.StartAfter) {
+			objects = append(objects, object)
+		}
+	}
+	m.mu.Unlock()
+
+	for len(objects) > 0 {
+		n := 2
+		if len(objects) < n {
+			n = len(objects)
+		}
+		if !fn(&s3.ListObjectsV2Output{Contents: objects[:n]}, n == len(objects)) {
+			return nil
+		}
+		objects = objects[n:]
+	}
+	return nil
+}
+
+func listedObject(key, etag string, modified time.Time) *s3.Object {
+	return &s3.Object{
+		Key:          aws.String(key),
+		ETag:         aws.String(`"` + etag + `"`),
+		Size:         aws.Int64(4),
+		LastModified: aws.Time(modified),
+	}
+}
+
+func TestS3ListFilters(t *testing.T) {
+
+	day := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	objects := []*s3.Object{
+		listedObject("in/2022/a.csv", "1", day),
+		listedObject("in/2022/b.csv", "2", day.Add(-48*time.Hour)),
+		listedObject("in/2022/c.json", "3", day),
+		listedObject("in/2022/d.csv", "4", day),
+		listedObject("in/2022/e/", "5", day),
+		listedObject("other/f.csv", "6", day),
+	}
+
+	cases := []struct {
+		cnf    S3ListConfig
+		expect []string
+	}{
+		{
+			cnf:    S3ListConfig{Bucket: "bucket", Prefix: "in/"},
+			expect: []string{"in/2022/a.csv", "in/2022/b.csv", "in/2022/c.json", "in/2022/d.csv"},
+		},
+		{
+			cnf:    S3ListConfig{Bucket: "bucket", Prefix: "in/", StartAfter: "in/2022/b.csv"},
+			expect: []string{"in/2022/c.json", "in/2022/d.csv"},
+		},
+		{
+			cnf:    S3ListConfig{Bucket: "bucket", Prefix: "in/", ModifiedSince: day},
+			expect: []string{"in/2022/a.csv", "in/2022/c.json", "in/2022/d.csv"},
+		},
+		{
+			cnf:    S3ListConfig{Bucket: "bucket", Pattern: "*/2022/*.csv"},
+			expect: []string{"in/2022/a.csv", "in/2022/b.csv", "in/2022/d.csv"},
+		},
+	}
+
+	for i, c := range cases {
+		api := &listAPIMock{objects: objects}
+		stg := s3ListStage{api: api, cnf: c.cnf}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		var keys []string
+		for event := range stg.List(ctx) {
+			if event.GetError() != nil {
+				t.Fatalf("case (%d) unexpected error %v", i, event.GetError())
+			}
+			if event.Bucket() != "bucket" || event.Meta().Size != 4 {
+				t.Fatalf("case (%d) unexpected meta %+v", i, event.Meta())
+			}
+			keys = append(keys, event.Key())
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("case (%d) test timedout", i)
+		}
+		cancel()
+
+		if !reflect.DeepEqual(keys, c.expect) {
+			t.Fatalf("case (%d) expecting %v got %v", i, c.expect, keys)
+		}
+	}
+}
+
+func TestS3ListScheduled(t *testing.T) {
+
+	day := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	api := &listAPIMock{}
+	api.set(listedObject("a.csv", "1", day), listedObject("b.csv", "1", day))
+
+	stg := s3ListStage{
+		api: api,
+		cnf: S3ListConfig{Bucket: "bucket", Interval: 10 * time.Millisecond},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eventCh := stg.List(ctx)
+
+	receive := func(n int, nack string) []string {
+		var ids []string
+		for len(ids) < n {
+			select {
+			case event := <-eventCh:
+				if event.GetError() != nil {
+					t.Fatalf("unexpected error %v", event.GetError())
+				}
+				ids = append(ids, event.Key()+"@"+event.Meta().ETag)
+				if event.Key() == nack {
+					event.GetAck().Nack(errors.New("failed"))
+				} else {
+					event.GetAck().Ack()
+				}
+			case <-time.After(1 * time.Second):
+				t.Fatalf("test timedout, got %v", ids)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	if ids := receive(2, ""); !reflect.DeepEqual(ids, []string{"a.csv@1", "b.csv@1"}) {
+		t.Fatalf("first scan expecting a.csv@1 b.csv@1 got %v", ids)
+	}
+
+	// a.csv is rewritten and c.csv is new
+	api.set(listedObject("a.csv", "2", day), listedObject("b.csv", "1", day), listedObject("c.csv", "1", day))
+	if ids := receive(2, "c.csv"); !reflect.DeepEqual(ids, []string{"a.csv@2", "c.csv@1"}) {
+		t.Fatalf("expecting a.csv@2 c.csv@1 got %v", ids)
+	}
+
+	// the nacked c.csv is emitted again
+	if ids := receive(1, ""); !reflect.DeepEqual(ids, []string{"c.csv@1"}) {
+		t.Fatalf("expecting c.csv@1 got %v", ids)
+	}
+
+	select {
+	case event := <-eventCh:
+		t.Fatalf("unexpected event %v", event.Key())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -5,54 +5,199 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
-func NewS3Stage(conf *aws.Config) s3Stage {
-	sess := session.Must(session.NewSession())
+// S3Config configures the clients of the s3 stage.
+type S3Config struct {
+	// Endpoint points the clients to an S3-compatible store such as MinIO
+	// or Ceph instead of AWS.
+	Endpoint string
+	// PathStyle addresses buckets as endpoint/bucket instead of
+	// bucket.endpoint, most S3-compatible stores require it.
+	PathStyle bool
+	// DisableSSL talks plain http to Endpoint.
+	DisableSSL bool
+	// DiscoverRegion looks up the region of every bucket and downloads
+	// with a client bound to it, so one pipeline can read from buckets in
+	// several regions. It is ignored when Endpoint is set.
+	DiscoverRegion bool
+	// Stream reads every object straight from GetObject instead of
+	// downloading it to the spill directory first. zip archives, which
+	// need random access, are always downloaded, and so is every object
+	// when Verify or Sidecar is set, it is checked before it is read.
+	Stream bool
+	// StreamMaxSize streams the objects whose notified size is at most
+	// StreamMaxSize bytes, larger ones are spilled to disk.
+	StreamMaxSize int64
+	// SpillDir holds the downloaded objects, the system temp directory
+	// when empty.
+	SpillDir string
+	// MaxSpillBytes bounds the disk used by downloaded objects and by the
+	// zip archives spilled while expanding them, new downloads wait while
+	// it is exhausted. 0 means unlimited.
+	MaxSpillBytes int64
+	// ObjectTimeout bounds a single attempt to read an object, streamed
+	// objects included. 0 means no timeout.
+	ObjectTimeout time.Duration
+	// Retry applies to the transient failures of reading an object.
+	Retry RetryPolicy
+	// Concurrency is the number of objects opened at once, 1 by default.
+	Concurrency int
+	// Prefetch is the number of opened objects that may wait for the
+	// consumer while it processes the current one.
+	Prefetch int
+	// PreserveOrder emits the objects in the order of their notifications
+	// instead of the order their downloads complete.
+	PreserveOrder bool
+	// Verify checks the content of every object against the MD5 of its
+	// ETag, for single part uploads, and the additional checksums S3 holds
+	// for it, such as SHA-256 or CRC32C.
+	Verify bool
+	// Sidecar checks the content of every object against the digest in the
+	// object named after it with the Sidecar extension, ".sha256", ".sha1"
+	// or ".md5". An object without its sidecar file yet is nacked, and the
+	// objects with the extension are skipped.
+	Sidecar string
+	// OnSuccess is applied to an object once every event read from it is
+	// acked, e.g. moving it to a processed/ prefix.
+	OnSuccess PostAction
+	// OnFailure is applied to an object once every event read from it is
+	// resolved and one of them failed, e.g. moving it to a failed/ prefix.
+	// The notification of an object handled by OnFailure is acked, it is
+	// only redelivered when OnFailure is empty or fails.
+	OnFailure PostAction
+}
 
-	downloader := s3manager.NewDownloader(sess)
+func NewS3Stage(cnf S3Config, awsCnf *aws.Config) s3Stage {
+	conf := aws.NewConfig()
+	if awsCnf != nil {
+		conf = awsCnf.Copy()
+	}
+	if cnf.Endpoint != "" {
+		conf = conf.WithEndpoint(cnf.Endpoint)
+	}
+	if cnf.PathStyle {
+		conf = conf.WithS3ForcePathStyle(true)
+	}
+	if cnf.DisableSSL {
+		conf = conf.WithDisableSSL(true)
+	}
 
-	s3Client := s3Client{
-		downloader,
+	sess := session.Must(session.NewSession(conf))
+	client := newS3Client(sess)
+
+	if cnf.DiscoverRegion && cnf.Endpoint == "" {
+		client.buckets = &bucketClients{
+			discover: func(ctx context.Context, bucket string) (string, error) {
+				return s3manager.GetBucketRegion(ctx, sess, bucket, aws.StringValue(sess.Config.Region))
+			},
+			newClient: func(region string) *s3Client {
+				return newS3Client(sess.Copy(&aws.Config{Region: aws.String(region)}))
+			},
+		}
 	}
 
 	return s3Stage{
-		s3Client,
+		client: *client,
+		cnf:    cnf,
+		budget: newDiskBudget(cnf.MaxSpillBytes),
 	}
 }
 
 type s3Stage struct {
 	client s3Client
+	cnf    S3Config
+	budget *diskBudget
 }
 
+// Fetch opens the object of every notification. Up to Concurrency objects
+// are opened at once and up to Prefetch opened objects wait for the
+// consumer, in notification order when PreserveOrder is set. Compressed
+// objects are decompressed and archives expanded to one file per entry.
 func (stg s3Stage) Fetch(ctx context.Context, s3NotificationCh chan S3Notification) chan FileInfo {
 
-	resultCh := make(chan FileInfo)
+	resultCh := make(chan FileInfo, stg.cnf.Prefetch)
 
 	sendResult := func(r *S3File) {
 		select {
 		case <-ctx.Done():
-			return
+			if r.f != nil {
+				r.f.Close()
+			}
 		case resultCh <- r:
-			return
 		}
 	}
 
+	// the post actions of a file run once it resolves, possibly after
+	// the last notification
+	late := newLateErrors(func(err error) {
+		sendResult(&S3File{err: err})
+	})
+
+	concurrency := stg.cnf.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
 	go func() {
-		defer close(resultCh)
+		defer late.close(func() { close(resultCh) })
 		defer fmt.Println("S3 closing")
 
-		for {
+		if stg.cnf.PreserveOrder {
+			stg.fetchOrdered(ctx, s3NotificationCh, concurrency, sendResult, late.report)
+			return
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case sqsMsg, ok := <-s3NotificationCh:
+						if !ok {
+							return
+						}
+						if stg.skip(sqsMsg) {
+							break
+						}
+						stg.expand(ctx, stg.fetchOne(ctx, sqsMsg, late.report), sendResult)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
 
+	return resultCh
+}
+
+// fetchOrdered opens up to concurrency objects at once and emits them in
+// the order of their notifications.
+func (stg s3Stage) fetchOrdered(ctx context.Context, s3NotificationCh chan S3Notification, concurrency int, sendResult func(*S3File), reportError func(error)) {
+
+	slots := make(chan chan *S3File, concurrency+stg.cnf.Prefetch)
+	sem := make(chan struct{}, concurrency)
+
+	go func() {
+		defer close(slots)
+		for {
 			select {
 			case <-ctx.Done():
 				return
@@ -60,90 +205,399 @@ func (stg s3Stage) Fetch(ctx context.Context, s3NotificationCh chan S3Notificati
 				if !ok {
 					return
 				}
-
-				if sqsMsg.GetError() != nil {
-					sendResult(&S3File{
-						err: sqsMsg.GetError(),
-					})
+				if stg.skip(sqsMsg) {
 					break
 				}
-				fmt.Println(sqsMsg.Bucket())
-				fmt.Println(sqsMsg.Key())
 
-				file, err := stg.client.downloadS3File(sqsMsg.Bucket(), sqsMsg.Key())
-
-				if err != nil {
-					sendResult(&S3File{
-						err: err,
-					})
-					break
+				// a published slot always gets a file, the download is
+				// started before it is published
+				select {
+				case <-ctx.Done():
+					return
+				case sem <- struct{}{}:
 				}
-
-				sendResult(&S3File{
-					f:        file,
-					fileName: file.Name(),
-					err:      err,
-				})
-
-				if sqsMsg.GetOnDone() != nil {
-					f := *sqsMsg.GetOnDone()
-					f()
+				slot := make(chan *S3File, 1)
+				go func() {
+					defer func() { <-sem }()
+					slot <- stg.fetchOne(ctx, sqsMsg, reportError)
+				}()
+
+				select {
+				case <-ctx.Done():
+					go func() {
+						if file := <-slot; file.f != nil {
+							file.f.Close()
+						}
+					}()
+					return
+				case slots <- slot:
 				}
 			}
 		}
 	}()
 
-	return resultCh
+	// after a cancellation sendResult closes the remaining files
+	for slot := range slots {
+		stg.expand(ctx, <-slot, sendResult)
+	}
+}
+
+// skip acks the notification of a sidecar file, it is read along with the
+// object it is named after.
+func (stg s3Stage) skip(sqsMsg S3Notification) bool {
+	if sqsMsg.GetError() != nil || stg.cnf.Sidecar == "" {
+		return false
+	}
+	if !strings.HasSuffix(sqsMsg.Meta().Key, stg.cnf.Sidecar) {
+		return false
+	}
+	sqsMsg.GetAck().Ack()
+	return true
+}
+
+// fetchOne opens the object of a notification and resolves the ack of the
+// notification, the returned event carries either the file or the error.
+// The errors of the post actions of the file go to reportError.
+func (stg s3Stage) fetchOne(ctx context.Context, sqsMsg S3Notification, reportError func(error)) *S3File {
+
+	if sqsMsg.GetError() != nil {
+		return &S3File{
+			err: sqsMsg.GetError(),
+		}
+	}
+	fmt.Println(sqsMsg.Bucket())
+	fmt.Println(sqsMsg.Key())
+
+	meta := sqsMsg.Meta()
+	client, err := stg.client.forBucket(ctx, meta.Bucket)
+	if err != nil {
+		sqsMsg.GetAck().Nack(err)
+		return &S3File{
+			err: err,
+		}
+	}
+
+	file, err := stg.open(ctx, client, meta)
+
+	if err != nil {
+		sqsMsg.GetAck().Nack(err)
+		return &S3File{
+			err: err,
+		}
+	}
+
+	result := &S3File{
+		f:        file,
+		fileName: meta.Key,
+		meta:     meta,
+		ack:      stg.postProcess(ctx, client, meta, sqsMsg.GetAck(), reportError),
+	}
+	sqsMsg.GetAck().Ack()
+
+	return result
+}
+
+// open returns a reader over the object of meta, either streamed from S3
+// or spilled to disk first. Closing the reader releases the spill file.
+// Transient failures are retried according to the retry policy.
+func (stg s3Stage) open(ctx context.Context, client *s3Client, meta ObjectMeta) (io.ReadCloser, error) {
+
+	var file io.ReadCloser
+	attempts, err := stg.cnf.Retry.do(ctx, isRetryableS3Error, func() error {
+		var err error
+		file, err = stg.openOnce(ctx, client, meta)
+		return err
+	})
+	if err != nil {
+		return nil, withAttempts(err, attempts)
+	}
+
+	return file, nil
+}
+
+func (stg s3Stage) openOnce(ctx context.Context, client *s3Client, meta ObjectMeta) (io.ReadCloser, error) {
+
+	cancel := func() {}
+	if stg.cnf.ObjectTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, stg.cnf.ObjectTimeout)
+	}
+
+	if stg.streamed(meta) {
+		body, err := client.streamS3File(ctx, meta.Bucket, meta.Key, meta.VersionID)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return &cancelOnClose{ReadCloser: body, cancel: cancel}, nil
+	}
+	defer cancel()
+
+	size := meta.Size
+	if size <= 0 && stg.budget != nil {
+		var err error
+		if size, err = client.objectSize(ctx, meta.Bucket, meta.Key, meta.VersionID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := stg.budget.acquire(ctx, size); err != nil {
+		return nil, fmt.Errorf("open: waiting for disk budget %w", err)
+	}
+
+	file, err := client.downloadS3File(ctx, stg.cnf.SpillDir, meta.Bucket, meta.Key, meta.VersionID)
+	if err != nil {
+		stg.budget.release(size)
+		return nil, err
+	}
+	file.budget = stg.budget
+	file.size = size
+
+	if err := stg.verifyDownload(ctx, client, meta, file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// streamed reports whether the object of meta is read straight from
+// GetObject rather than downloaded first.
+func (stg s3Stage) streamed(meta ObjectMeta) bool {
+	if stg.cnf.Verify || stg.cnf.Sidecar != "" {
+		return false
+	}
+	if strings.EqualFold(path.Ext(meta.Key), ".zip") {
+		return false
+	}
+	return stg.cnf.Stream || (meta.Size > 0 && meta.Size <= stg.cnf.StreamMaxSize)
 }
 
 type s3Client struct {
+	api        s3iface.S3API
 	downloader s3manageriface.DownloaderAPI
+	// buckets holds the clients bound to the region of each bucket, when
+	// nil this client serves every bucket.
+	buckets *bucketClients
+}
+
+func newS3Client(sess *session.Session) *s3Client {
+	api := s3.New(sess)
+	return &s3Client{
+		api:        api,
+		downloader: s3manager.NewDownloaderWithClient(api),
+	}
 }
 
-func (s *s3Client) downloadS3File(bucket, key string) (*os.File, error) {
+// forBucket returns the client to use for bucket.
+func (s *s3Client) forBucket(ctx context.Context, bucket string) (*s3Client, error) {
+	if s.buckets == nil {
+		return s, nil
+	}
+	return s.buckets.get(ctx, bucket)
+}
+
+// bucketClients caches the region of every bucket and one client per region.
+type bucketClients struct {
+	discover  func(ctx context.Context, bucket string) (string, error)
+	newClient func(region string) *s3Client
+
+	mu       sync.Mutex
+	byBucket map[string]*s3Client
+	byRegion map[string]*s3Client
+}
 
-	tmpf, err := ioutil.TempFile("", fmt.Sprintf("%v-*", key))
+// get returns the client of the region of bucket. The region is discovered
+// without holding the lock, a slow bucket does not stall the others. Two
+// fetches of a new bucket may both discover it, the first one is kept.
+func (bc *bucketClients) get(ctx context.Context, bucket string) (*s3Client, error) {
+	bc.mu.Lock()
+	client, ok := bc.byBucket[bucket]
+	bc.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	region, err := bc.discover(ctx, bucket)
 	if err != nil {
-		return nil, fmt.Errorf("download: failed to create a new tmp file %w", err)
+		return nil, wrapError(fmt.Errorf("forBucket: failed to discover the region of bucket %v %w", bucket, err))
 	}
 
-	_, err = s.downloader.Download(tmpf, &s3.GetObjectInput{
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if client, ok := bc.byBucket[bucket]; ok {
+		return client, nil
+	}
+	if bc.byBucket == nil {
+		bc.byBucket = make(map[string]*s3Client)
+		bc.byRegion = make(map[string]*s3Client)
+	}
+
+	client, ok = bc.byRegion[region]
+	if !ok {
+		client = bc.newClient(region)
+		bc.byRegion[region] = client
+	}
+	bc.byBucket[bucket] = client
+
+	return client, nil
+}
+
+func objectInput(bucket, key, versionID string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	return input
+}
+
+// downloadS3File downloads the given version of the object, the latest one
+// when versionID is empty, to a spill file in dir.
+func (s *s3Client) downloadS3File(ctx context.Context, dir, bucket, key, versionID string) (*spillFile, error) {
 
+	tmpf, err := newSpillFile(dir, key)
 	if err != nil {
-		// os.Remove(tmpf.Name())
-		var s3Error awserr.Error
-
-		if errors.As(err, &s3Error) {
-			switch s3Error.Code() {
-			case s3.ErrCodeNoSuchKey:
-				return nil, wrapError(fmt.Errorf("download: %v file not found %w ", key, err))
-			case s3.ErrCodeNoSuchBucket:
-				return nil, wrapError(fmt.Errorf("download: %v bucket not found %w ", key, err))
-			default:
-				return nil, fmt.Errorf("download: failed to download the file %v %w ", key, err)
-			}
+		return nil, fmt.Errorf("download: %w", err)
+	}
 
-		} else {
-			return nil, fmt.Errorf("download: failed to download the file %v %w ", key, err)
-		}
+	_, err = s.downloader.DownloadWithContext(ctx, tmpf.File, objectInput(bucket, key, versionID))
+	if err != nil {
+		tmpf.Close()
+		return nil, downloadError(key, err)
+	}
 
+	if _, err := tmpf.Seek(0, io.SeekStart); err != nil {
+		tmpf.Close()
+		return nil, fmt.Errorf("download: failed to rewind %v %w", tmpf.Name(), err)
 	}
 
 	return tmpf, nil
 }
 
+// streamS3File returns the body of the given version of the object.
+func (s *s3Client) streamS3File(ctx context.Context, bucket, key, versionID string) (io.ReadCloser, error) {
+
+	out, err := s.api.GetObjectWithContext(ctx, objectInput(bucket, key, versionID))
+	if err != nil {
+		return nil, downloadError(key, err)
+	}
+
+	return out.Body, nil
+}
+
+func (s *s3Client) objectSize(ctx context.Context, bucket, key, versionID string) (int64, error) {
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	out, err := s.api.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		return 0, downloadError(key, err)
+	}
+
+	return aws.Int64Value(out.ContentLength), nil
+}
+
+// permanentS3Errors are the error codes a retry can not fix.
+var permanentS3Errors = map[string]bool{
+	s3.ErrCodeNoSuchKey:    true,
+	s3.ErrCodeNoSuchBucket: true,
+	"NoSuchVersion":        true,
+	"NotFound":             true,
+	"AccessDenied":         true,
+	"Forbidden":            true,
+	"InvalidObjectState":   true,
+	"PreconditionFailed":   true,
+}
+
+// isRetryableS3Error tells transient failures such as throttling, 5xx
+// responses, connection resets and timeouts from permanent ones.
+func isRetryableS3Error(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() >= 500 {
+		return true
+	}
+
+	var s3Error awserr.Error
+	if errors.As(err, &s3Error) {
+		if permanentS3Errors[s3Error.Code()] {
+			return false
+		}
+		if s3Error.Code() == request.CanceledErrorCode || s3Error.Code() == "SlowDown" {
+			return true
+		}
+		return request.IsErrorRetryable(s3Error) || request.IsErrorThrottle(s3Error)
+	}
+
+	return false
+}
+
+// cancelOnClose releases the context of a streamed object with its body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func downloadError(key string, err error) error {
+	var s3Error awserr.Error
+
+	if errors.As(err, &s3Error) {
+		switch s3Error.Code() {
+		case s3.ErrCodeNoSuchKey:
+			return wrapError(fmt.Errorf("download: %v file not found %w ", key, err))
+		case s3.ErrCodeNoSuchBucket:
+			return wrapError(fmt.Errorf("download: %v bucket not found %w ", key, err))
+		case "PreconditionFailed":
+			return wrapError(fmt.Errorf("download: %v changed since its notification %w ", key, err))
+		}
+	}
+
+	return fmt.Errorf("download: failed to download the file %v %w ", key, err)
+}
+
+// ObjectMeta describes the S3 object version an event originates from.
+type ObjectMeta struct {
+	Bucket    string
+	Key       string
+	VersionID string
+	ETag      string
+	Sequencer string
+	Size      int64
+	EventTime time.Time
+}
+
 type S3File struct {
-	f        io.Reader
+	f        io.ReadCloser
 	err      error
 	fileName string
-	done     *func()
+	meta     ObjectMeta
+	ack      *Acker
+	// source is the spill file f is decompressed from, if any.
+	source *spillFile
 }
 
-func (f *S3File) GetOnDone() *func() {
-	return f.done
+func (f *S3File) GetAck() *Acker {
+	return f.ack
 }
 
 func (f *S3File) GetError() error {
@@ -154,6 +608,10 @@ func (f *S3File) FileName() string {
 	return f.fileName
 }
 
-func (f *S3File) File() io.Reader {
+func (f *S3File) File() io.ReadCloser {
 	return f.f
 }
+
+func (f *S3File) Meta() ObjectMeta {
+	return f.meta
+}
@@ -1,21 +1,36 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
 type downloaderMock struct {
 	s3manageriface.DownloaderAPI
-	fileText string
+	fileText  string
+	versionID string
 }
 
-func (sm downloaderMock) Download(destination io.WriterAt, s3Object *s3.GetObjectInput, fn ...func(*s3manager.Downloader)) (int64, error) {
+func (sm downloaderMock) DownloadWithContext(ctx aws.Context, destination io.WriterAt, s3Object *s3.GetObjectInput, fn ...func(*s3manager.Downloader)) (int64, error) {
+	if aws.StringValue(s3Object.VersionId) != sm.versionID {
+		return 0, fmt.Errorf("unexpected version %v", aws.StringValue(s3Object.VersionId))
+	}
 	n, err := destination.WriteAt([]byte(sm.fileText), 0)
 	if err != nil {
 		return 0, err
@@ -29,6 +44,7 @@ func TestDownloadS3File(t *testing.T) {
 		fileContent string
 		bucket      string
 		key         string
+		versionID   string
 		expectedRes []byte
 		expectedErr error
 	}{
@@ -39,19 +55,28 @@ func TestDownloadS3File(t *testing.T) {
 			expectedRes: []byte("hello"),
 			expectedErr: nil,
 		},
+		{
+			fileContent: "hello",
+			bucket:      "bucketName",
+			key:         "2022/05/test.csv",
+			versionID:   "3HL4kqtJlcpXroDTDmJ",
+			expectedRes: []byte("hello"),
+			expectedErr: nil,
+		},
 	}
 
 	for i, c := range cases {
 
 		s3Client := s3Client{
 			downloader: downloaderMock{
-				fileText: c.fileContent,
+				fileText:  c.fileContent,
+				versionID: c.versionID,
 			},
 		}
-		f, err := s3Client.downloadS3File(c.bucket, c.key)
+		f, err := s3Client.downloadS3File(context.Background(), t.TempDir(), c.bucket, c.key, c.versionID)
 
 		if err != nil {
-			t.Fatalf("case (%d) unexpected method called", i)
+			t.Fatalf("case (%d) unexpected error %v", i, err)
 		}
 
 		fileContent := make([]byte, len(c.expectedRes))
@@ -65,6 +90,551 @@ func TestDownloadS3File(t *testing.T) {
 			t.Fatalf("case (%d) expecting %v got %v ", i, c.expectedRes, fileContent)
 		}
 
+		if err := f.Close(); err != nil {
+			t.Fatalf("case (%d) unexpected error at closing file %v", i, err)
+		}
+		if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+			t.Fatalf("case (%d) expecting %v to be removed", i, f.Name())
+		}
+
+	}
+
+}
+
+type s3APIMock struct {
+	s3iface.S3API
+	objects map[string]string
+	// etags and sha256s, base64 encoded, are returned when set, the
+	// latter only when the checksum mode is enabled.
+	etags   map[string]string
+	sha256s map[string]string
+}
+
+func (m s3APIMock) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	key := aws.StringValue(in.Key)
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	out := &s3.GetObjectOutput{
+		Body:          io.NopCloser(strings.NewReader(content)),
+		ContentLength: aws.Int64(int64(len(content))),
+	}
+	if etag, ok := m.etags[key]; ok {
+		out.ETag = aws.String(etag)
+	}
+	if sha, ok := m.sha256s[key]; ok && aws.StringValue(in.ChecksumMode) == s3.ChecksumModeEnabled {
+		out.ChecksumSHA256 = aws.String(sha)
+	}
+	return out, nil
+}
+
+func (m s3APIMock) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	key := aws.StringValue(in.Key)
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, awserr.New("NotFound", "not found", nil)
+	}
+	out := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(content))),
+	}
+	if etag, ok := m.etags[key]; ok {
+		out.ETag = aws.String(etag)
+	}
+	if sha, ok := m.sha256s[key]; ok && aws.StringValue(in.ChecksumMode) == s3.ChecksumModeEnabled {
+		out.ChecksumSHA256 = aws.String(sha)
+	}
+	return out, nil
+}
+
+func TestFetchStreamAndSpill(t *testing.T) {
+
+	objects := map[string]string{
+		"small.csv": "a\n1\n",
+		"large.csv": "a\n1\n2\n3\n",
+	}
+
+	cases := []struct {
+		key          string
+		size         int64
+		expectStream bool
+	}{
+		{key: "small.csv", size: 4, expectStream: true},
+		{key: "large.csv", size: 8, expectStream: false},
+		{key: "large.csv", size: 0, expectStream: false},
+	}
+
+	for i, c := range cases {
+		spillDir := t.TempDir()
+		stg := s3Stage{
+			client: s3Client{
+				api:        s3APIMock{objects: objects},
+				downloader: downloaderMock{fileText: objects[c.key]},
+			},
+			cnf: S3Config{
+				StreamMaxSize: 4,
+				SpillDir:      spillDir,
+			},
+			budget: newDiskBudget(100),
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		notificationCh := make(chan S3Notification, 1)
+		notificationCh <- &SQSS3Event{
+			message: Record{
+				S3Data: S3{
+					Bucket: Bucket{Name: "bucket"},
+					Object: Object{Key: c.key, Size: int(c.size)},
+				},
+			},
+		}
+
+		var fileInfo FileInfo
+		select {
+		case fileInfo = <-stg.Fetch(ctx, notificationCh):
+		case <-time.After(1 * time.Second):
+			t.Fatalf("case (%d) test timedout", i)
+		}
+		if fileInfo.GetError() != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, fileInfo.GetError())
+		}
+
+		spilled, _ := os.ReadDir(spillDir)
+		if c.expectStream == (len(spilled) != 0) {
+			t.Fatalf("case (%d) expecting stream %v got %d spilled files", i, c.expectStream, len(spilled))
+		}
+		if fileInfo.FileName() != c.key {
+			t.Fatalf("case (%d) expecting file name %v got %v", i, c.key, fileInfo.FileName())
+		}
+
+		content, err := io.ReadAll(fileInfo.File())
+		if err != nil || string(content) != objects[c.key] {
+			t.Fatalf("case (%d) expecting %q got %q %v", i, objects[c.key], content, err)
+		}
+
+		fileInfo.File().Close()
+		if spilled, _ := os.ReadDir(spillDir); len(spilled) != 0 {
+			t.Fatalf("case (%d) expecting the spill file to be removed", i)
+		}
+		if stg.budget.used != 0 {
+			t.Fatalf("case (%d) expecting the budget to be released got %d", i, stg.budget.used)
+		}
+		cancel()
+	}
+}
+
+func TestDiskBudget(t *testing.T) {
+
+	budget := newDiskBudget(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := budget.acquire(ctx, 8); err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- budget.acquire(ctx, 5)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("acquired more than the budget")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	budget.release(8)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer timeoutCancel()
+	if err := budget.acquire(timeoutCtx, 20); err == nil {
+		t.Fatalf("unexpected oversized acquire while the budget is in use")
+	}
+
+	budget.release(5)
+	if err := budget.acquire(ctx, 20); err != nil {
+		t.Fatalf("expecting an oversized acquire on an empty budget got %v", err)
+	}
+}
+
+func TestNewS3StageConfig(t *testing.T) {
+
+	stg := NewS3Stage(S3Config{
+		Endpoint:  "http://localhost:9000",
+		PathStyle: true,
+	}, aws.NewConfig().WithRegion("eu-central-1"))
+
+	svc := stg.client.downloader.(*s3manager.Downloader).S3.(*s3.S3)
+
+	if svc.Client.Config.Region == nil || *svc.Client.Config.Region != "eu-central-1" {
+		t.Fatalf("expecting region eu-central-1 got %v", aws.StringValue(svc.Client.Config.Region))
+	}
+	if svc.Client.Endpoint != "http://localhost:9000" {
+		t.Fatalf("expecting the custom endpoint got %v", svc.Client.Endpoint)
+	}
+	if !aws.BoolValue(svc.Client.Config.S3ForcePathStyle) {
+		t.Fatalf("expecting path style addressing")
+	}
+	if stg.client.buckets != nil {
+		t.Fatalf("expecting no region discovery with a custom endpoint")
+	}
+}
+
+func TestBucketClients(t *testing.T) {
+
+	regions := map[string]string{
+		"bucket-a": "eu-central-1",
+		"bucket-b": "us-east-1",
+		"bucket-c": "eu-central-1",
+	}
+	discovered := 0
+
+	client := &s3Client{
+		buckets: &bucketClients{
+			discover: func(ctx context.Context, bucket string) (string, error) {
+				discovered++
+				region, ok := regions[bucket]
+				if !ok {
+					return "", fmt.Errorf("NotFound")
+				}
+				return region, nil
+			},
+			newClient: func(region string) *s3Client {
+				return &s3Client{
+					downloader: downloaderMock{fileText: region},
+				}
+			},
+		},
+	}
+
+	ctx := context.Background()
+	for _, bucket := range []string{"bucket-a", "bucket-b", "bucket-c", "bucket-a"} {
+		c, err := client.forBucket(ctx, bucket)
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+		if region := c.downloader.(downloaderMock).fileText; region != regions[bucket] {
+			t.Fatalf("expecting a %v client for %v got %v", regions[bucket], bucket, region)
+		}
+	}
+
+	if discovered != 3 {
+		t.Fatalf("expecting 3 region lookups got %d", discovered)
+	}
+	if len(client.buckets.byRegion) != 2 {
+		t.Fatalf("expecting 2 regional clients got %d", len(client.buckets.byRegion))
+	}
+
+	if _, err := client.forBucket(ctx, "missing"); err == nil {
+		t.Fatalf("expecting an error for an unknown bucket")
+	}
+}
+
+type flakyDownloaderMock struct {
+	s3manageriface.DownloaderAPI
+	errs  []error
+	calls int
+}
+
+func (m *flakyDownloaderMock) DownloadWithContext(ctx aws.Context, destination io.WriterAt, s3Object *s3.GetObjectInput, fn ...func(*s3manager.Downloader)) (int64, error) {
+	m.calls++
+	if m.calls <= len(m.errs) {
+		return 0, m.errs[m.calls-1]
+	}
+	n, err := destination.WriteAt([]byte("a\n1\n"), 0)
+	return int64(n), err
+}
+
+func TestBucketClientsSlowDiscover(t *testing.T) {
+
+	started, slow := make(chan struct{}), make(chan struct{})
+	client := &s3Client{
+		buckets: &bucketClients{
+			discover: func(ctx context.Context, bucket string) (string, error) {
+				if bucket == "slow-bucket" {
+					close(started)
+					<-slow
+				}
+				return "eu-central-1", nil
+			},
+			newClient: func(region string) *s3Client {
+				return &s3Client{}
+			},
+		},
+	}
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.forBucket(ctx, "slow-bucket")
+		done <- err
+	}()
+	<-started
+
+	fast := make(chan error, 1)
+	go func() {
+		_, err := client.forBucket(ctx, "fast-bucket")
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatalf("unexpected err %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expecting a bucket not to wait for the discovery of another")
+	}
+
+	close(slow)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+	if len(client.buckets.byRegion) != 1 || len(client.buckets.byBucket) != 2 {
+		t.Fatalf("expecting 2 buckets sharing 1 regional client got %d buckets %d clients", len(client.buckets.byBucket), len(client.buckets.byRegion))
+	}
+}
+
+func TestOpenRetry(t *testing.T) {
+
+	unavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "try again", nil), 503, "req")
+	throttled := awserr.New("SlowDown", "slow down", nil)
+	notFound := awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "req")
+
+	cases := []struct {
+		errs           []error
+		expectCalls    int
+		expectErr      bool
+		expectAttempts int
+	}{
+		{errs: nil, expectCalls: 1},
+		{errs: []error{unavailable, throttled}, expectCalls: 3},
+		{errs: []error{unavailable, unavailable, unavailable}, expectCalls: 3, expectErr: true, expectAttempts: 3},
+		{errs: []error{notFound}, expectCalls: 1, expectErr: true, expectAttempts: 1},
+		{errs: []error{denied}, expectCalls: 1, expectErr: true, expectAttempts: 1},
+	}
+
+	for i, c := range cases {
+		downloader := &flakyDownloaderMock{errs: c.errs}
+		stg := s3Stage{
+			cnf: S3Config{
+				SpillDir: t.TempDir(),
+				Retry: RetryPolicy{
+					MaxAttempts: 3,
+					BaseDelay:   time.Millisecond,
+				},
+			},
+		}
+
+		file, err := stg.open(context.Background(), &s3Client{downloader: downloader}, ObjectMeta{Bucket: "bucket", Key: "test.csv", Size: 4})
+
+		if downloader.calls != c.expectCalls {
+			t.Fatalf("case (%d) expecting %d calls got %d", i, c.expectCalls, downloader.calls)
+		}
+
+		if !c.expectErr {
+			if err != nil {
+				t.Fatalf("case (%d) unexpected err %v", i, err)
+			}
+			file.Close()
+			continue
+		}
+
+		var appErr *AppError
+		if !errors.As(err, &appErr) {
+			t.Fatalf("case (%d) expecting an AppError got %v", i, err)
+		}
+		if appErr.Misc["attempts"] != c.expectAttempts {
+			t.Fatalf("case (%d) expecting %d attempts got %v", i, c.expectAttempts, appErr.Misc["attempts"])
+		}
+	}
+}
+
+func TestOpenCancelled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	downloader := &flakyDownloaderMock{
+		errs: []error{awserr.New(request.CanceledErrorCode, "canceled", context.Canceled)},
+	}
+	stg := s3Stage{
+		cnf: S3Config{
+			SpillDir: t.TempDir(),
+		},
+	}
+
+	if _, err := stg.open(ctx, &s3Client{downloader: downloader}, ObjectMeta{Key: "test.csv", Size: 4}); err == nil {
+		t.Fatalf("expecting an error")
+	}
+	if downloader.calls != 1 {
+		t.Fatalf("expecting no retry after cancellation got %d calls", downloader.calls)
+	}
+}
+
+type slowDownloaderMock struct {
+	s3manageriface.DownloaderAPI
+	delays map[string]time.Duration
+
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (m *slowDownloaderMock) DownloadWithContext(ctx aws.Context, destination io.WriterAt, s3Object *s3.GetObjectInput, fn ...func(*s3manager.Downloader)) (int64, error) {
+	m.mu.Lock()
+	m.running++
+	if m.running > m.peak {
+		m.peak = m.running
+	}
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.running--
+		m.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(m.delays[aws.StringValue(s3Object.Key)]):
+	}
+
+	n, err := destination.WriteAt([]byte("a\n1\n"), 0)
+	return int64(n), err
+}
+
+func TestFetchConcurrency(t *testing.T) {
+
+	keys := []string{"slow.csv", "medium.csv", "fast.csv"}
+	delays := map[string]time.Duration{
+		"slow.csv":   80 * time.Millisecond,
+		"medium.csv": 45 * time.Millisecond,
+		"fast.csv":   15 * time.Millisecond,
+	}
+
+	cases := []struct {
+		preserveOrder bool
+		expect        []string
+	}{
+		{preserveOrder: true, expect: []string{"slow.csv", "medium.csv", "fast.csv"}},
+		{preserveOrder: false, expect: []string{"fast.csv", "medium.csv", "slow.csv"}},
+	}
+
+	for i, c := range cases {
+		downloader := &slowDownloaderMock{delays: delays}
+		stg := s3Stage{
+			client: s3Client{downloader: downloader},
+			cnf: S3Config{
+				SpillDir:      t.TempDir(),
+				Concurrency:   3,
+				PreserveOrder: c.preserveOrder,
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		notificationCh := make(chan S3Notification, len(keys))
+		for _, key := range keys {
+			notificationCh <- &SQSS3Event{
+				message: Record{
+					S3Data: S3{Object: Object{Key: key, Size: 4}},
+				},
+			}
+		}
+		close(notificationCh)
+
+		var got []string
+		for fileInfo := range stg.Fetch(ctx, notificationCh) {
+			if fileInfo.GetError() != nil {
+				t.Fatalf("case (%d) unexpected error %v", i, fileInfo.GetError())
+			}
+			got = append(got, fileInfo.FileName())
+			fileInfo.File().Close()
+		}
+		cancel()
+
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("case (%d) expecting %v got %v", i, c.expect, got)
+		}
+		if downloader.peak != 3 {
+			t.Fatalf("case (%d) expecting 3 concurrent downloads got %d", i, downloader.peak)
+		}
 	}
+}
+
+func TestFetchOrderedCancelled(t *testing.T) {
+
+	downloader := &slowDownloaderMock{delays: map[string]time.Duration{
+		"blocked.csv": time.Hour,
+		"next.csv":    time.Hour,
+	}}
+	stg := s3Stage{
+		client: s3Client{downloader: downloader},
+		cnf: S3Config{
+			SpillDir:      t.TempDir(),
+			Concurrency:   1,
+			PreserveOrder: true,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notificationCh := make(chan S3Notification, 2)
+	for _, key := range []string{"blocked.csv", "next.csv"} {
+		notificationCh <- &SQSS3Event{
+			message: Record{
+				S3Data: S3{Object: Object{Key: key, Size: 4}},
+			},
+		}
+	}
+	close(notificationCh)
+
+	resultCh := stg.Fetch(ctx, notificationCh)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
 
+	timeout := time.After(1 * time.Second)
+	for {
+		select {
+		case _, ok := <-resultCh:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expecting the output to close after the cancellation")
+		}
+	}
+}
+
+func TestStreamed(t *testing.T) {
+
+	cases := []struct {
+		cnf    S3Config
+		meta   ObjectMeta
+		expect bool
+	}{
+		{cnf: S3Config{Stream: true}, meta: ObjectMeta{Key: "a.csv"}, expect: true},
+		{cnf: S3Config{Stream: true}, meta: ObjectMeta{Key: "a.ZIP"}, expect: false},
+		{cnf: S3Config{StreamMaxSize: 10}, meta: ObjectMeta{Key: "a.csv", Size: 10}, expect: true},
+		{cnf: S3Config{StreamMaxSize: 10}, meta: ObjectMeta{Key: "a.csv", Size: 11}, expect: false},
+		{cnf: S3Config{StreamMaxSize: 10}, meta: ObjectMeta{Key: "a.zip", Size: 10}, expect: false},
+		{cnf: S3Config{Stream: true, Verify: true}, meta: ObjectMeta{Key: "a.csv"}, expect: false},
+		{cnf: S3Config{StreamMaxSize: 10, Sidecar: ".sha256"}, meta: ObjectMeta{Key: "a.csv", Size: 10}, expect: false},
+	}
+
+	for i, c := range cases {
+		if got := (s3Stage{cnf: c.cnf}).streamed(c.meta); got != c.expect {
+			t.Fatalf("case (%d) expecting streamed %v got %v", i, c.expect, got)
+		}
+	}
 }
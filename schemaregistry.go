@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegistryTimeout = 10 * time.Second
+	registryContentType    = "application/vnd.schemaregistry.v1+json"
+)
+
+// schemaRegistry is a client of a Confluent compatible schema registry.
+type schemaRegistry struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+	retry    RetryPolicy
+}
+
+func newSchemaRegistry(cnf AvroConfig) *schemaRegistry {
+	timeout := cnf.Timeout
+	if timeout <= 0 {
+		timeout = defaultRegistryTimeout
+	}
+	return &schemaRegistry{
+		url:      strings.TrimSuffix(cnf.RegistryURL, "/"),
+		username: cnf.Username,
+		password: cnf.Password,
+		client:   &http.Client{Timeout: timeout},
+		retry:    cnf.Retry,
+	}
+}
+
+// registryError is an error response of the registry.
+type registryError struct {
+	StatusCode int    `json:"-"`
+	ErrorCode  int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("schemaRegistry: %v (%d)", e.Message, e.ErrorCode)
+}
+
+// rejected tells the errors of a subject or a schema, such as an
+// incompatible schema, from the failures of the registry.
+func (e *registryError) rejected() bool {
+	switch e.StatusCode {
+	case http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// isRejectedSchema reports whether err is the registry rejecting a subject
+// or a schema.
+func isRejectedSchema(err error) bool {
+	var regErr *registryError
+	return errors.As(err, &regErr) && regErr.rejected()
+}
+
+func isRetryableRegistryError(err error) bool {
+	var regErr *registryError
+	if errors.As(err, &regErr) {
+		return regErr.StatusCode >= 500 || regErr.StatusCode == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// register registers schema under subject and returns its id, the id it
+// already has when it is registered.
+func (r *schemaRegistry) register(ctx context.Context, subject, schema string) (int, error) {
+
+	var resp struct {
+		ID int `json:"id"`
+	}
+	err := r.do(ctx, http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", map[string]string{"schema": schema}, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("schemaRegistry: failed to register a schema of %v %w", subject, err)
+	}
+
+	return resp.ID, nil
+}
+
+// latest returns the id and the schema of the latest version of subject.
+func (r *schemaRegistry) latest(ctx context.Context, subject string) (int, string, error) {
+
+	var resp struct {
+		ID     int    `json:"id"`
+		Schema string `json:"schema"`
+	}
+	err := r.do(ctx, http.MethodGet, "/subjects/"+url.PathEscape(subject)+"/versions/latest", nil, &resp)
+	if err != nil {
+		return 0, "", fmt.Errorf("schemaRegistry: failed to get the schema of %v %w", subject, err)
+	}
+
+	return resp.ID, resp.Schema, nil
+}
+
+// do sends a request to the registry, retrying its failures, and decodes
+// the response to out.
+func (r *schemaRegistry) do(ctx context.Context, method, path string, in, out interface{}) error {
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.retry.do(ctx, isRetryableRegistryError, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, r.url+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", registryContentType)
+		if in != nil {
+			req.Header.Set("Content-Type", registryContentType)
+		}
+		if r.username != "" {
+			req.SetBasicAuth(r.username, r.password)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			regErr := &registryError{StatusCode: resp.StatusCode}
+			if json.NewDecoder(resp.Body).Decode(regErr) != nil || regErr.Message == "" {
+				regErr.Message = resp.Status
+			}
+			return regErr
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	})
+
+	return err
+}
@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// registryStandIn is a schema registry which rejects a schema dropping a
+// field of the previous version of its subject as incompatible.
+type registryStandIn struct {
+	mu       sync.Mutex
+	subjects map[string][]string
+	ids      map[string]int
+	// failures is the number of requests answered with 500 before the
+	// registry recovers.
+	failures int
+}
+
+func newRegistryStandIn() *registryStandIn {
+	return &registryStandIn{
+		subjects: make(map[string][]string),
+		ids:      make(map[string]int),
+	}
+}
+
+func (rs *registryStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	writeJSON := func(code int, v interface{}) {
+		w.Header().Set("Content-Type", registryContentType)
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	if rs.failures > 0 {
+		rs.failures--
+		writeJSON(http.StatusInternalServerError, map[string]interface{}{"error_code": 50001, "message": "store error"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/")
+	if len(parts) < 2 || parts[1] != "versions" {
+		writeJSON(http.StatusNotFound, map[string]interface{}{"error_code": 404, "message": "HTTP 404 Not Found"})
+		return
+	}
+	subject := parts[0]
+	versions := rs.subjects[subject]
+
+	if r.Method == http.MethodGet {
+		if len(versions) == 0 {
+			writeJSON(http.StatusNotFound, map[string]interface{}{"error_code": 40401, "message": "Subject '" + subject + "' not found."})
+			return
+		}
+		schema := versions[len(versions)-1]
+		writeJSON(http.StatusOK, map[string]interface{}{"subject": subject, "version": len(versions), "id": rs.ids[schema], "schema": schema})
+		return
+	}
+
+	var req struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Header.Get("Content-Type") != registryContentType {
+		writeJSON(http.StatusUnprocessableEntity, map[string]interface{}{"error_code": 42201, "message": "Invalid schema"})
+		return
+	}
+	if id, exist := rs.ids[req.Schema]; exist {
+		writeJSON(http.StatusOK, map[string]interface{}{"id": id})
+		return
+	}
+	if len(versions) > 0 {
+		previous, _ := parseAvroSchema(versions[len(versions)-1])
+		next, err := parseAvroSchema(req.Schema)
+		if err != nil {
+			writeJSON(http.StatusUnprocessableEntity, map[string]interface{}{"error_code": 42201, "message": "Invalid schema"})
+			return
+		}
+		names := make(map[string]bool)
+		for _, f := range next.fields {
+			names[f.name] = true
+		}
+		for _, f := range previous.fields {
+			if !names[f.name] {
+				writeJSON(http.StatusConflict, map[string]interface{}{"error_code": 409, "message": "Schema being registered is incompatible with an earlier schema"})
+				return
+			}
+		}
+	}
+
+	rs.ids[req.Schema] = len(rs.ids) + 1
+	rs.subjects[subject] = append(versions, req.Schema)
+	writeJSON(http.StatusOK, map[string]interface{}{"id": rs.ids[req.Schema]})
+}
+
+func TestSchemaRegistry(t *testing.T) {
+
+	standIn := newRegistryStandIn()
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	registry := newSchemaRegistry(AvroConfig{
+		RegistryURL: srv.URL + "/",
+		Retry:       RetryPolicy{BaseDelay: time.Millisecond},
+	})
+	ctx := context.Background()
+
+	v1 := `{"type":"record","name":"r","fields":[{"name":"a","type":"string"},{"name":"b","type":"string"}]}`
+	v2 := `{"type":"record","name":"r","fields":[{"name":"a","type":"string"}]}`
+
+	if _, _, err := registry.latest(ctx, "orders-value"); !isRejectedSchema(err) {
+		t.Fatalf("expecting an unknown subject error got %v", err)
+	}
+
+	// the registry recovers within the retries
+	standIn.mu.Lock()
+	standIn.failures = 2
+	standIn.mu.Unlock()
+	id, err := registry.register(ctx, "orders-value", v1)
+	if err != nil || id != 1 {
+		t.Fatalf("expecting id 1 got %d %v", id, err)
+	}
+	if id, err := registry.register(ctx, "orders-value", v1); err != nil || id != 1 {
+		t.Fatalf("expecting the registered id 1 got %d %v", id, err)
+	}
+
+	_, err = registry.register(ctx, "orders-value", v2)
+	if !isRejectedSchema(err) || !strings.Contains(err.Error(), "incompatible") {
+		t.Fatalf("expecting an incompatible schema error got %v", err)
+	}
+
+	id, schema, err := registry.latest(ctx, "orders-value")
+	if err != nil || id != 1 || schema != v1 {
+		t.Fatalf("expecting the latest schema to be v1 got %d %v %v", id, schema, err)
+	}
+
+	// the registry does not recover
+	standIn.mu.Lock()
+	standIn.failures = 10
+	standIn.mu.Unlock()
+	_, err = registry.register(ctx, "users-value", v1)
+	if err == nil || isRejectedSchema(err) || !isRetryableRegistryError(err) {
+		t.Fatalf("expecting a registry failure got %v", err)
+	}
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	if standIn.failures != 10-defaultRetryAttempts {
+		t.Fatalf("expecting %d attempts got %d", defaultRetryAttempts, 10-standIn.failures)
+	}
+}
@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// valueSerializer encodes the value of the message of a row for topic. An
+// error marked terminal fails the row, any other is written to the error
+// topic.
+type valueSerializer interface {
+	Serialize(ctx context.Context, topic string, fileRow FileRow) ([]byte, error)
+}
+
+// jsonSerializer writes the rows as JSON.
+type jsonSerializer struct{}
+
+func (jsonSerializer) Serialize(ctx context.Context, topic string, fileRow FileRow) ([]byte, error) {
+	value, err := json.Marshal(fileRow.Data())
+	if err != nil {
+		return nil, fmt.Errorf("CreateKafkaMessage: json marshal failed %w", err)
+	}
+	return value, nil
+}
+
+// AvroConfig writes the value messages in Avro, framed in the wire format of
+// the Confluent schema registry: a zero byte, the 4 bytes big-endian id of
+// the schema, then the record. The schema of a topic is registered under
+// the <topic>-value subject.
+type AvroConfig struct {
+	// RegistryURL is the schema registry, the messages are written as JSON
+	// when it is empty.
+	RegistryURL string
+	// Username and Password authenticate to the registry with basic auth.
+	Username string
+	Password string
+	// Schemas are the record schemas of the topics, by topic. Their fields
+	// hold the columns of the same name and can be primitives or unions of
+	// null and a primitive.
+	Schemas map[string]string
+	// LoadLatest writes the topics without a schema in Schemas with the
+	// latest schema registered for them. Otherwise their schema is derived
+	// from the columns of the rows, as nullable strings.
+	LoadLatest bool
+	// Namespace is the namespace of the derived schemas.
+	Namespace string
+	// Timeout bounds a request to the registry, 10s by default.
+	Timeout time.Duration
+	Retry   RetryPolicy
+}
+
+// serializer returns the serializer cnf configures.
+func (cnf AvroConfig) serializer() (valueSerializer, error) {
+
+	if cnf.RegistryURL == "" {
+		return jsonSerializer{}, nil
+	}
+
+	schemas := make(map[string]*avroSchema, len(cnf.Schemas))
+	for topic, text := range cnf.Schemas {
+		schema, err := parseAvroSchema(text)
+		if err != nil {
+			return nil, fmt.Errorf("avroConfig: invalid schema of %v %w", topic, err)
+		}
+		schemas[topic] = schema
+	}
+
+	return &avroSerializer{
+		registry:   newSchemaRegistry(cnf),
+		schemas:    schemas,
+		loadLatest: cnf.LoadLatest,
+		namespace:  cnf.Namespace,
+		codecs:     make(map[string]*avroCodec),
+	}, nil
+}
+
+type avroSerializer struct {
+	registry   *schemaRegistry
+	schemas    map[string]*avroSchema
+	loadLatest bool
+	namespace  string
+
+	mu     sync.Mutex
+	codecs map[string]*avroCodec
+}
+
+// avroCodec is a registered schema, or the error it was rejected with so
+// that it is not registered again for every row.
+type avroCodec struct {
+	id     int
+	schema *avroSchema
+	err    error
+}
+
+func (as *avroSerializer) Serialize(ctx context.Context, topic string, fileRow FileRow) ([]byte, error) {
+
+	row, ok := fileRow.Data().(map[string]string)
+	if !ok {
+		return nil, fmt.Errorf("avro: the rows of %v have no columns", fileRow.FileName())
+	}
+
+	codec, err := as.codec(ctx, topic, row)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 5, 5+64)
+	binary.BigEndian.PutUint32(buf[1:], uint32(codec.id))
+	value, err := codec.schema.encode(buf, row)
+	if err != nil {
+		return nil, fmt.Errorf("avro: failed to encode a row of %v %w", fileRow.FileName(), err)
+	}
+
+	return value, nil
+}
+
+// codec returns the schema of the rows of topic shaped like row. The
+// failures of the registry are terminal, the schemas it rejects are not.
+func (as *avroSerializer) codec(ctx context.Context, topic string, row map[string]string) (*avroCodec, error) {
+
+	id := topic
+	var columns []string
+	if as.schemas[topic] == nil && !as.loadLatest {
+		// the derived schemas depend on the columns
+		for column := range row {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		id = topic + "\x00" + strings.Join(columns, "\x00")
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if codec, exist := as.codecs[id]; exist {
+		return codec, codec.err
+	}
+
+	subject := topic + "-value"
+	codec := &avroCodec{schema: as.schemas[topic]}
+	var err error
+	switch {
+	case codec.schema != nil:
+		codec.id, err = as.registry.register(ctx, subject, codec.schema.text)
+	case as.loadLatest:
+		var text string
+		if codec.id, text, err = as.registry.latest(ctx, subject); err == nil {
+			codec.schema, codec.err = parseAvroSchema(text)
+		}
+	default:
+		if codec.schema, codec.err = deriveAvroSchema(topic, as.namespace, columns); codec.err == nil {
+			codec.id, err = as.registry.register(ctx, subject, codec.schema.text)
+		}
+	}
+
+	if err != nil && !isRejectedSchema(err) {
+		if ctx.Err() == nil {
+			err = terminal(err)
+		}
+		return nil, err
+	}
+	if err != nil {
+		codec.err = err
+	}
+	as.codecs[id] = codec
+	return codec, codec.err
+}
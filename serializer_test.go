@@ -0,0 +1,182 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateMessageAvro(t *testing.T) {
+
+	standIn := newRegistryStandIn()
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	serializer, err := AvroConfig{
+		RegistryURL: srv.URL,
+		Schemas: map[string]string{
+			"typed": `{"type":"record","name":"typed","fields":[{"name":"id","type":"long"}]}`,
+		},
+		Retry: RetryPolicy{MaxAttempts: 1},
+	}.serializer()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ks := &kafkaStage{
+		valueTopic: "orders",
+		errorTopic: "error",
+		serializer: serializer,
+	}
+
+	row := func(data map[string]string) FileRow {
+		return &csvRow{data: data, fileName: "a.csv"}
+	}
+
+	cases := []struct {
+		topic       string
+		row         FileRow
+		expectTopic string
+		expectID    uint32
+		expectValue []byte
+		expectError string
+	}{
+		{
+			row:         row(map[string]string{"a": "x", "b": "y"}),
+			expectTopic: "orders",
+			expectID:    1,
+			expectValue: []byte{0x02, 0x02, 'x', 0x02, 0x02, 'y'},
+		},
+		{
+			// the schema is registered once
+			row:         row(map[string]string{"a": "z", "b": ""}),
+			expectTopic: "orders",
+			expectID:    1,
+			expectValue: []byte{0x02, 0x02, 'z', 0x02, 0x00},
+		},
+		{
+			// adding a column is compatible
+			row:         row(map[string]string{"a": "x", "b": "y", "c": "z"}),
+			expectTopic: "orders",
+			expectID:    2,
+			expectValue: []byte{0x02, 0x02, 'x', 0x02, 0x02, 'y', 0x02, 0x02, 'z'},
+		},
+		{
+			// dropping one is not
+			row:         row(map[string]string{"a": "x"}),
+			expectTopic: "error",
+			expectError: "incompatible",
+		},
+		{
+			topic:       "typed",
+			row:         row(map[string]string{"id": "-1"}),
+			expectTopic: "typed",
+			expectID:    3,
+			expectValue: []byte{0x01},
+		},
+		{
+			topic:       "typed",
+			row:         row(map[string]string{"id": "one"}),
+			expectTopic: "error",
+			expectError: "invalid long value of column id",
+		},
+		{
+			row:         &csvRow{data: []string{"x"}, fileName: "a.csv"},
+			expectTopic: "error",
+			expectError: "have no columns",
+		},
+	}
+
+	for i, c := range cases {
+		ks.valueTopic = "orders"
+		if c.topic != "" {
+			ks.valueTopic = c.topic
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		fileRowCh := make(chan FileRow, 1)
+		fileRowCh <- c.row
+		close(fileRowCh)
+
+		var msgs []KafkaMessageInt
+		for msg := range ks.CreateMessage(ctx, fileRowCh) {
+			msgs = append(msgs, msg)
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("case (%d) test timedout", i)
+		}
+		cancel()
+
+		if len(msgs) != 1 || msgs[0].GetError() != nil {
+			t.Fatalf("case (%d) expecting a message got %v", i, msgs)
+		}
+		msg := msgs[0].Message()
+		if msg.Topic != c.expectTopic {
+			t.Fatalf("case (%d) expecting topic %v got %v %s", i, c.expectTopic, msg.Topic, msg.Value)
+		}
+		if c.expectError != "" {
+			if !strings.Contains(string(msg.Value), c.expectError) {
+				t.Fatalf("case (%d) expecting error %q got %s", i, c.expectError, msg.Value)
+			}
+			continue
+		}
+
+		if len(msg.Value) < 5 || msg.Value[0] != 0 {
+			t.Fatalf("case (%d) expecting the wire format got % x", i, msg.Value)
+		}
+		if id := binary.BigEndian.Uint32(msg.Value[1:5]); id != c.expectID {
+			t.Fatalf("case (%d) expecting schema id %d got %d", i, c.expectID, id)
+		}
+		if string(msg.Value[5:]) != string(c.expectValue) {
+			t.Fatalf("case (%d) expecting % x got % x", i, c.expectValue, msg.Value[5:])
+		}
+	}
+}
+
+func TestCreateMessageAvroRegistryDown(t *testing.T) {
+
+	standIn := newRegistryStandIn()
+	standIn.failures = 1
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	serializer, err := AvroConfig{
+		RegistryURL: srv.URL,
+		LoadLatest:  true,
+		Retry:       RetryPolicy{MaxAttempts: 1},
+	}.serializer()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ks := &kafkaStage{
+		valueTopic:     "orders",
+		errorTopic:     "error",
+		serializer:     serializer,
+		messageBatcher: newMessageBatcher(&writerMock{}, KafkaConfig{}),
+	}
+
+	nacked := false
+	ack := NewAcker(nil, func(error) { nacked = true })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	fileRowCh := make(chan FileRow, 1)
+	fileRowCh <- &csvRow{data: map[string]string{"a": "x"}, fileName: "a.csv", ack: ack}
+	close(fileRowCh)
+
+	// a failing registry fails the row instead of writing it to the error
+	// topic
+	var events []GenericEventInt
+	for event := range ks.SendMessage(ctx, ks.CreateMessage(ctx, fileRowCh)) {
+		events = append(events, event)
+	}
+	if len(events) != 1 || !errors.Is(events[0].GetError(), ErrTerminal) {
+		t.Fatalf("expecting a terminal error got %v", events)
+	}
+	if !nacked {
+		t.Fatalf("expecting the row to be nacked")
+	}
+}
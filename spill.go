@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// diskBudget bounds the bytes held by spill files. A file larger than the
+// whole budget is still admitted once nothing else is spilled.
+type diskBudget struct {
+	mu      sync.Mutex
+	max     int64
+	used    int64
+	changed chan struct{}
+}
+
+// newDiskBudget returns nil, an unlimited budget, when max is not positive.
+func newDiskBudget(max int64) *diskBudget {
+	if max <= 0 {
+		return nil
+	}
+
+	return &diskBudget{
+		max:     max,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire blocks until n bytes fit in the budget or ctx is cancelled.
+func (b *diskBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.max {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// grow accounts for n bytes already written without waiting, so that the
+// next acquisitions wait for them to be released.
+func (b *diskBudget) grow(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used += n
+	b.mu.Unlock()
+}
+
+func (b *diskBudget) release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// spillFile is a file written to the spill directory. Closing it removes it
+// from disk and returns its share of the budget.
+type spillFile struct {
+	*os.File
+	budget *diskBudget
+	size   int64
+	once   sync.Once
+}
+
+// newSpillFile creates an empty file in dir, the system temp directory when
+// dir is empty, for an object called name.
+func newSpillFile(dir, name string) (*spillFile, error) {
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("%v-*", path.Base(name)))
+	if err != nil {
+		return nil, fmt.Errorf("spill: failed to create a new tmp file %w", err)
+	}
+
+	return &spillFile{
+		File: f,
+	}, nil
+}
+
+func (f *spillFile) Close() error {
+	var err error
+	f.once.Do(func() {
+		err = f.File.Close()
+		if rmErr := os.Remove(f.Name()); rmErr != nil && err == nil {
+			err = fmt.Errorf("spill: failed to remove %v %w", f.Name(), rmErr)
+		}
+		f.budget.release(f.size)
+	})
+	return err
+}
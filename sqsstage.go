@@ -2,8 +2,10 @@ package pipeline
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -11,98 +13,571 @@ import (
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
-func NewSQSStage(queue string, awsCnf aws.Config) sqsStage {
+const (
+	defaultSQSDeleteInterval  = time.Second
+	defaultSQSWaitTimeSeconds = 20
+	defaultSQSVisibility      = 30
+	defaultSQSMaxLifetime     = time.Hour
+	defaultSQSMaxReceiveCount = 5
+	sqsMaxBatchSize           = 10
+	sqsErrorBackoff           = time.Second
+)
+
+// SQSConfig configures the queue consumer of the sqs stage, zero values are
+// replaced by defaults.
+type SQSConfig struct {
+	QueueURL string
+	// MaxMessages is the number of messages requested per receive call, at
+	// most 10.
+	MaxMessages int64
+	// WaitTimeSeconds is the long polling duration of a receive call, at
+	// most 20.
+	WaitTimeSeconds int64
+	// Pollers is the number of concurrent receive loops.
+	Pollers int
+	// MaxInFlight bounds the messages that are received but not yet acked
+	// or nacked. Pollers stop receiving while the bound is reached so
+	// messages are not pulled faster than the pipeline consumes them.
+	MaxInFlight int
+	// DeleteInterval is the longest time an acked message waits for its
+	// deletion batch to fill up.
+	DeleteInterval time.Duration
+	// VisibilityTimeout is the visibility in seconds set on every
+	// extension of an in-flight message.
+	VisibilityTimeout int64
+	// HeartbeatInterval is the period of the visibility extensions, it
+	// defaults to a third of VisibilityTimeout.
+	HeartbeatInterval time.Duration
+	// MaxLifetime stops the extensions of a message that is not resolved
+	// in time, letting the queue redeliver it.
+	MaxLifetime time.Duration
+	// NackVisibilityTimeout is the visibility in seconds set on a nacked
+	// message, 0 makes it available for a retry right away.
+	NackVisibilityTimeout int64
+	// MaxReceiveCount is the number of receives after which a message that
+	// can not be parsed is dropped, 5 by default. A negative value keeps it
+	// on the queue.
+	MaxReceiveCount int
+	// DeadLetterQueueURL receives the dropped messages, when empty they
+	// are deleted.
+	DeadLetterQueueURL string
+	// Decoder parses the message bodies, it defaults to
+	// NewNotificationDecoder() which accepts every event.
+	Decoder NotificationDecoder
+}
+
+func (c SQSConfig) withDefaults() SQSConfig {
+	if c.MaxMessages <= 0 || c.MaxMessages > sqsMaxBatchSize {
+		c.MaxMessages = sqsMaxBatchSize
+	}
+	if c.WaitTimeSeconds <= 0 || c.WaitTimeSeconds > defaultSQSWaitTimeSeconds {
+		c.WaitTimeSeconds = defaultSQSWaitTimeSeconds
+	}
+	if c.Pollers <= 0 {
+		c.Pollers = 1
+	}
+	if c.MaxInFlight <= 0 {
+		c.MaxInFlight = int(c.MaxMessages) * c.Pollers
+	}
+	if c.DeleteInterval <= 0 {
+		c.DeleteInterval = defaultSQSDeleteInterval
+	}
+	if c.VisibilityTimeout <= 0 {
+		c.VisibilityTimeout = defaultSQSVisibility
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = time.Duration(c.VisibilityTimeout) * time.Second / 3
+	}
+	if c.MaxLifetime <= 0 {
+		c.MaxLifetime = defaultSQSMaxLifetime
+	}
+	if c.MaxReceiveCount == 0 {
+		c.MaxReceiveCount = defaultSQSMaxReceiveCount
+	}
+	if c.NackVisibilityTimeout < 0 {
+		c.NackVisibilityTimeout = 0
+	}
+	return c
+}
+
+func NewSQSStage(cnf SQSConfig, awsCnf aws.Config) sqsStage {
 
 	sess := session.Must(session.NewSession(&awsCnf))
+	cnf = cnf.withDefaults()
 
 	return sqsStage{
 		sqsQueue: sqsQueue{
-			client: sqs.New(sess),
-			url:    queue,
+			client:        sqs.New(sess),
+			url:           cnf.QueueURL,
+			waitTime:      cnf.WaitTimeSeconds,
+			messageFormat: cnf.Decoder,
 		},
+		cnf: cnf,
 	}
 
 }
 
 type sqsStage struct {
 	sqsQueue sqsQueue
+	cnf      SQSConfig
 }
 
+// ReadMessages long polls the queue until ctx is cancelled and emits one
+// S3Notification per record of the received messages. A message is deleted
+// from the queue once every record it carries is acked.
 func (s sqsStage) ReadMessages(ctx context.Context) chan S3Notification {
 
+	cnf := s.cnf.withDefaults()
 	resultCh := make(chan S3Notification)
+	sendResult := func(r *SQSS3Event) {
+		select {
+		case <-ctx.Done():
+		case resultCh <- r:
+		}
+	}
+
+	deleter := newSQSDeleter(&s.sqsQueue, cnf.DeleteInterval)
+	limiter := newInflightLimiter(cnf.MaxInFlight)
+
+	var wg sync.WaitGroup
+	wg.Add(cnf.Pollers + 1)
+
 	go func() {
-		defer close(resultCh)
+		defer wg.Done()
+		deleter.run(ctx, func(err error) {
+			sendResult(&SQSS3Event{
+				err: err,
+			})
+		})
+	}()
 
-		sqsMessages, err := s.sqsQueue.fetchMessages(10)
-		if err != nil {
-			resultCh <- &SQSS3Event{
-				err: fmt.Errorf("messages: %w", err),
-			}
+	for i := 0; i < cnf.Pollers; i++ {
+		go func() {
+			defer wg.Done()
+			s.poll(ctx, cnf, &wg, deleter, limiter, sendResult)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	return resultCh
+
+}
+
+func (s sqsStage) poll(ctx context.Context, cnf SQSConfig, wg *sync.WaitGroup, deleter *sqsDeleter, limiter *inflightLimiter, sendResult func(*SQSS3Event)) {
+
+	for {
+		n := limiter.reserve(ctx, int(cnf.MaxMessages))
+		if n == 0 {
 			return
 		}
 
-		for _, message := range sqsMessages {
+		sqsMessages, err := s.sqsQueue.fetchMessages(ctx, int64(n))
+		if err != nil {
+			limiter.release(n)
+			if ctx.Err() != nil {
+				return
+			}
 
+			sendResult(&SQSS3Event{
+				err: fmt.Errorf("messages: %w", err),
+			})
 			select {
 			case <-ctx.Done():
 				return
-			case resultCh <- &SQSS3Event{
-				message: message,
-				done:    getRemoveQueueFunc(message.S3Data.Object.Key),
-			}:
+			case <-time.After(sqsErrorBackoff):
 			}
-
+			continue
 		}
+		limiter.release(n - len(sqsMessages))
 
-	}()
+		for _, message := range sqsMessages {
 
-	return resultCh
+			if message.err != nil {
+				sendResult(&SQSS3Event{
+					err: message.err,
+				})
+				if err := s.reject(cnf, message, deleter); err != nil {
+					sendResult(&SQSS3Event{
+						err: err,
+					})
+				}
+				limiter.release(1)
+				continue
+			}
+
+			resolved := make(chan error, 1)
+			wg.Add(1)
+			go func(message queueMessage) {
+				defer wg.Done()
+				s.heartbeat(ctx, cnf, message, resolved, sendResult)
+			}(message)
+
+			ack := s.track(message, resolved, deleter, limiter)
+			for _, record := range message.records {
+				sendResult(&SQSS3Event{
+					message: record,
+					ack:     ack.Derive(),
+				})
+			}
+			ack.Ack()
 
+		}
+	}
 }
 
 type sqsQueue struct {
-	client sqsiface.SQSAPI
-	url    string
+	client        sqsiface.SQSAPI
+	url           string
+	waitTime      int64
+	messageFormat NotificationDecoder
 }
 
-func (q *sqsQueue) fetchMessages(numberOfMSG int64) ([]Record, error) {
+func (q *sqsQueue) decoder() NotificationDecoder {
+	if q.messageFormat == nil {
+		return NewNotificationDecoder()
+	}
+	return q.messageFormat
+}
+
+// queueMessage is a received message, err is set when its body could not be
+// parsed.
+type queueMessage struct {
+	id            string
+	receiptHandle string
+	body          string
+	receiveCount  int
+	records       []Record
+	err           error
+}
+
+func (q *sqsQueue) fetchMessages(ctx context.Context, numberOfMSG int64) ([]queueMessage, error) {
 
-	receivedMsg, err := q.client.ReceiveMessage(&sqs.ReceiveMessageInput{
+	receivedMsg, err := q.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
 		AttributeNames: []*string{
 			aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount),
 		},
 		MessageAttributeNames: []*string{
 			aws.String(sqs.QueueAttributeNameAll),
 		},
 		QueueUrl:            aws.String(q.url),
 		MaxNumberOfMessages: aws.Int64(numberOfMSG),
+		WaitTimeSeconds:     aws.Int64(q.waitTime),
 	})
 
 	if err != nil {
 		return nil, fmt.Errorf("fetchMessage: faild to fetch messages from aws sqs %w", err)
 	}
 
-	// fmt.Printf("sqs msg: %v \n", len(receivedMsg.Messages))
-
-	var result []Record
+	var result []queueMessage
 	for _, msg := range receivedMsg.Messages {
 
-		var message Message
-		if err := json.Unmarshal([]byte(*msg.Body), &message); err != nil {
-			return nil, fmt.Errorf("fetchMessage: failed to parse sqs message %w", err)
+		qm := queueMessage{
+			id:            aws.StringValue(msg.MessageId),
+			receiptHandle: aws.StringValue(msg.ReceiptHandle),
+			body:          aws.StringValue(msg.Body),
+		}
+		if count, ok := msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+			qm.receiveCount, _ = strconv.Atoi(aws.StringValue(count))
+		}
+
+		records, err := q.decoder().Decode([]byte(qm.body))
+		if err != nil {
+			appErr := wrapError(fmt.Errorf("fetchMessage: failed to parse sqs message %v %w", qm.id, err))
+			appErr.Misc["messageId"] = qm.id
+			appErr.Misc["body"] = qm.body
+			qm.err = appErr
+			result = append(result, qm)
+			continue
+		}
+
+		for i := range records {
+			records[i].ReceiptHandle = qm.receiptHandle
 		}
-		result = append(result, message.Records...)
+		qm.records = records
+		result = append(result, qm)
 	}
 
 	return result, nil
 }
 
-func getRemoveQueueFunc(name string) *func() {
-	f := func() {
-		fmt.Printf("Removing msg %v \n", name)
+// sendTo copies message to the queue at url, used to move poison messages
+// to a dead-letter queue.
+func (q *sqsQueue) sendTo(url string, message queueMessage) error {
+
+	_, err := q.client.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(url),
+		MessageBody: aws.String(message.body),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"SourceMessageId": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(message.id),
+			},
+		},
+	})
+	if err != nil {
+		return wrapError(fmt.Errorf("sendTo: failed to move message %v to %v %w", message.id, url, err))
 	}
-	return &f
+
+	return nil
+}
+
+func (q *sqsQueue) changeVisibility(message queueMessage, timeout int64) error {
+
+	_, err := q.client.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.url),
+		ReceiptHandle:     aws.String(message.receiptHandle),
+		VisibilityTimeout: aws.Int64(timeout),
+	})
+	if err != nil {
+		return wrapError(fmt.Errorf("changeVisibility: failed to change the visibility of message %v %w", message.id, err))
+	}
+
+	return nil
+}
+
+// deleteMessages removes the given messages with as few DeleteMessageBatch
+// calls as possible and returns one error per message that was not deleted.
+func (q *sqsQueue) deleteMessages(messages []queueMessage) []error {
+
+	var errs []error
+	for len(messages) > 0 {
+		n := len(messages)
+		if n > sqsMaxBatchSize {
+			n = sqsMaxBatchSize
+		}
+		batch := messages[:n]
+		messages = messages[n:]
+
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(batch))
+		for i, m := range batch {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: aws.String(m.receiptHandle),
+			})
+		}
+
+		out, err := q.client.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(q.url),
+			Entries:  entries,
+		})
+		if err != nil {
+			for _, m := range batch {
+				errs = append(errs, wrapError(fmt.Errorf("deleteMessages: failed to delete message %v %w", m.id, err)))
+			}
+			continue
+		}
+
+		for _, failed := range out.Failed {
+			i, err := strconv.Atoi(aws.StringValue(failed.Id))
+			if err != nil || i >= len(batch) {
+				continue
+			}
+			errs = append(errs, wrapError(fmt.Errorf("deleteMessages: failed to delete message %v %v: %v", batch[i].id, aws.StringValue(failed.Code), aws.StringValue(failed.Message))))
+		}
+	}
+
+	return errs
+}
+
+// track returns the root acker of message. Acking it queues the message for
+// deletion while a nack leaves it on the queue for redelivery, both free its
+// in-flight slot and report the outcome on resolved.
+func (s sqsStage) track(message queueMessage, resolved chan error, deleter *sqsDeleter, limiter *inflightLimiter) *Acker {
+	return NewAcker(
+		func() {
+			resolved <- nil
+			deleter.enqueue(message)
+			limiter.release(1)
+		},
+		func(err error) {
+			fmt.Printf("Leaving msg %v for redelivery: %v \n", message.id, err)
+			resolved <- err
+			limiter.release(1)
+		},
+	)
+}
+
+// reject applies the poison message policy to a message that can not be
+// parsed: once it was received MaxReceiveCount times it is moved to the
+// dead-letter queue, or deleted when none is configured. Until then it is
+// made visible again for another attempt.
+func (s sqsStage) reject(cnf SQSConfig, message queueMessage, deleter *sqsDeleter) error {
+
+	if cnf.MaxReceiveCount <= 0 || message.receiveCount < cnf.MaxReceiveCount {
+		return s.sqsQueue.changeVisibility(message, cnf.NackVisibilityTimeout)
+	}
+
+	if cnf.DeadLetterQueueURL != "" {
+		if err := s.sqsQueue.sendTo(cnf.DeadLetterQueueURL, message); err != nil {
+			return err
+		}
+	}
+	deleter.enqueue(message)
+
+	return nil
+}
+
+// heartbeat extends the visibility of message until it is resolved or its
+// max lifetime is reached. A nacked message is made visible again after
+// NackVisibilityTimeout.
+func (s sqsStage) heartbeat(ctx context.Context, cnf SQSConfig, message queueMessage, resolved chan error, sendResult func(*SQSS3Event)) {
+
+	ticker := time.NewTicker(cnf.HeartbeatInterval)
+	defer ticker.Stop()
+
+	lifetime := time.NewTimer(cnf.MaxLifetime)
+	defer lifetime.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-resolved:
+			if err == nil {
+				return
+			}
+			if err := s.sqsQueue.changeVisibility(message, cnf.NackVisibilityTimeout); err != nil {
+				sendResult(&SQSS3Event{
+					err: err,
+				})
+			}
+			return
+		case <-lifetime.C:
+			sendResult(&SQSS3Event{
+				err: wrapError(fmt.Errorf("heartbeat: message %v exceeded its max lifetime of %v", message.id, cnf.MaxLifetime)),
+			})
+			return
+		case <-ticker.C:
+			if err := s.sqsQueue.changeVisibility(message, cnf.VisibilityTimeout); err != nil {
+				sendResult(&SQSS3Event{
+					err: err,
+				})
+			}
+		}
+	}
+}
+
+// sqsDeleter coalesces the deletion of acked messages into batches. Acks are
+// queued without blocking so a slow consumer of the error events can never
+// stall the stage that acks.
+type sqsDeleter struct {
+	queue    *sqsQueue
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []queueMessage
+	notify  chan struct{}
+}
+
+func newSQSDeleter(queue *sqsQueue, interval time.Duration) *sqsDeleter {
+	return &sqsDeleter{
+		queue:    queue,
+		interval: interval,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+func (d *sqsDeleter) enqueue(message queueMessage) {
+	d.mu.Lock()
+	d.pending = append(d.pending, message)
+	d.mu.Unlock()
+
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run deletes the queued messages until ctx is cancelled, messages acked
+// before the cancellation are still deleted.
+func (d *sqsDeleter) run(ctx context.Context, onErr func(error)) {
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	flush := func(all bool) {
+		d.mu.Lock()
+		n := len(d.pending)
+		if !all {
+			n -= n % sqsMaxBatchSize
+		}
+		batch := d.pending[:n]
+		d.pending = d.pending[n:]
+		d.mu.Unlock()
+
+		for _, err := range d.queue.deleteMessages(batch) {
+			onErr(err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush(true)
+			return
+		case <-ticker.C:
+			flush(true)
+		case <-d.notify:
+			flush(false)
+		}
+	}
+}
+
+// inflightLimiter bounds the number of received messages that are not
+// resolved yet.
+type inflightLimiter struct {
+	mu       sync.Mutex
+	max      int
+	inflight int
+	changed  chan struct{}
+}
+
+func newInflightLimiter(max int) *inflightLimiter {
+	return &inflightLimiter{
+		max:     max,
+		changed: make(chan struct{}),
+	}
+}
+
+// reserve blocks until at least one slot is free and reserves up to want
+// slots. It returns the number of reserved slots, 0 when ctx is cancelled.
+func (l *inflightLimiter) reserve(ctx context.Context, want int) int {
+	for {
+		l.mu.Lock()
+		if free := l.max - l.inflight; free > 0 {
+			if want > free {
+				want = free
+			}
+			l.inflight += want
+			l.mu.Unlock()
+			return want
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-changed:
+		}
+	}
+}
+
+func (l *inflightLimiter) release(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.inflight -= n
+	close(l.changed)
+	l.changed = make(chan struct{})
+	l.mu.Unlock()
 }
 
 type Message struct {
@@ -110,7 +585,9 @@ type Message struct {
 }
 
 type Record struct {
-	S3Data        S3 `json:"s3"`
+	EventName     string    `json:"eventName"`
+	EventTime     time.Time `json:"eventTime"`
+	S3Data        S3        `json:"s3"`
 	ReceiptHandle string
 }
 
@@ -124,14 +601,17 @@ type Bucket struct {
 }
 
 type Object struct {
-	Key  string
-	Size int
+	Key       string `json:"key"`
+	Size      int    `json:"size"`
+	VersionID string `json:"versionId"`
+	ETag      string `json:"eTag"`
+	Sequencer string `json:"sequencer"`
 }
 
 type SQSS3Event struct {
 	err     error
 	message Record
-	done    *func()
+	ack     *Acker
 }
 
 func (sqsEvent *SQSS3Event) Bucket() string {
@@ -142,8 +622,21 @@ func (sqsEvent *SQSS3Event) Key() string {
 	return sqsEvent.message.S3Data.Object.Key
 }
 
-func (sqsEvent *SQSS3Event) GetOnDone() *func() {
-	return sqsEvent.done
+func (sqsEvent *SQSS3Event) Meta() ObjectMeta {
+	object := sqsEvent.message.S3Data.Object
+	return ObjectMeta{
+		Bucket:    sqsEvent.message.S3Data.Bucket.Name,
+		Key:       object.Key,
+		VersionID: object.VersionID,
+		ETag:      object.ETag,
+		Sequencer: object.Sequencer,
+		Size:      int64(object.Size),
+		EventTime: sqsEvent.message.EventTime,
+	}
+}
+
+func (sqsEvent *SQSS3Event) GetAck() *Acker {
+	return sqsEvent.ack
 }
 
 func (sqsEvent *SQSS3Event) GetError() error {
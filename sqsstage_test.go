@@ -2,22 +2,98 @@ package pipeline
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 )
 
 type mockedReceiveMsgs struct {
 	sqsiface.SQSAPI
-	msg sqs.ReceiveMessageOutput
+	msg        sqs.ReceiveMessageOutput
+	failDelete map[string]bool
+
+	mu           sync.Mutex
+	received     bool
+	deleted      []string
+	visibilities []int64
+	sent         []string
+}
+
+func (m *mockedReceiveMsgs) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, aws.StringValue(in.QueueUrl))
+	return &sqs.SendMessageOutput{}, nil
+}
+
+// ReceiveMessageWithContext returns msg on the first call and then behaves
+// like an empty long poll.
+func (m *mockedReceiveMsgs) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	m.mu.Lock()
+	received := m.received
+	m.received = true
+	m.mu.Unlock()
+
+	if !received {
+		return &m.msg, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(10 * time.Millisecond):
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
 }
 
-func (m *mockedReceiveMsgs) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	return &m.msg, nil
+func (m *mockedReceiveMsgs) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.visibilities = append(m.visibilities, aws.Int64Value(in.VisibilityTimeout))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (m *mockedReceiveMsgs) visibilityChanges() []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int64(nil), m.visibilities...)
+}
+
+func (m *mockedReceiveMsgs) deletedHandles() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.deleted...)
+}
+
+func (m *mockedReceiveMsgs) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, e := range in.Entries {
+		handle := aws.StringValue(e.ReceiptHandle)
+		if m.failDelete[handle] {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id:      e.Id,
+				Code:    aws.String("ReceiptHandleIsInvalid"),
+				Message: aws.String("invalid"),
+			})
+			continue
+		}
+		m.deleted = append(m.deleted, handle)
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
 }
 
 const correctSQSMSG string = `{"Records":[{"eventVersion":"2.1","eventSource":"aws:s3","awsRegion":"eu-central-1","eventTime":"2022-04-28T15:02:12.748Z","eventName":"ObjectCreated:CompleteMultipartUpload","userIdentity":{"principalId":"AWS:AIDAQ57GTTLQBWHPMCL2X"},"requestParameters":{"sourceIPAddress":"87.141.46.58"},"responseElements":{"x-amz-request-id":"FHNYVGN3ZQ9QEK8P","x-amz-id-2":"syNQ04BievqNMY8dnRoeiT1W4P7mqcCcAXPTQ6A14P4/ySkxTb3q/3UxAvknB9ErpIs/h+6o0a/eBnEZbyCDTTT9rNPISkEF"},"s3":{"s3SchemaVersion":"1.0","configurationId":"file-notification","bucket":{"name":"pysf-kafka-to-s3","ownerIdentity":{"principalId":"A17B0OXGJAG3T0"},"arn":"arn:aws:s3:::pysf-kafka-to-s3"},"object":{"key":"2mSalesRecords.csv","size":249602748,"eTag":"274024ceb1d84a2e5add322f5000e77b-24","sequencer":"00626AAC632158F7EA"}}}]}`
@@ -37,12 +113,16 @@ func TestGetMessage(t *testing.T) {
 			},
 			expect: []Record{
 				{
+					EventName: "ObjectCreated:CompleteMultipartUpload",
+					EventTime: time.Date(2022, 4, 28, 15, 2, 12, 748000000, time.UTC),
 					S3Data: S3{
 						Bucket: Bucket{
 							Name: "pysf-kafka-to-s3"},
 						Object: Object{
-							Key:  "2mSalesRecords.csv",
-							Size: 249602748,
+							Key:       "2mSalesRecords.csv",
+							Size:      249602748,
+							ETag:      "274024ceb1d84a2e5add322f5000e77b-24",
+							Sequencer: "00626AAC632158F7EA",
 						},
 					},
 				},
@@ -56,7 +136,9 @@ func TestGetMessage(t *testing.T) {
 			},
 			expect: []Record{
 				{
-					S3Data: S3{},
+					EventName: "ObjectCreated:CompleteMultipartUpload",
+					EventTime: time.Date(2022, 4, 28, 15, 2, 12, 748000000, time.UTC),
+					S3Data:    S3{},
 				},
 			},
 		},
@@ -69,11 +151,16 @@ func TestGetMessage(t *testing.T) {
 			url:    "test-queue",
 		}
 
-		resp, err := q.fetchMessages(10)
+		messages, err := q.fetchMessages(context.Background(), 10)
 		if err != nil {
 			t.Fatalf("unexpected err %v", err)
 		}
 
+		var resp []Record
+		for _, m := range messages {
+			resp = append(resp, m.records...)
+		}
+
 		if !reflect.DeepEqual(resp, c.expect) {
 			t.Fatalf("%d ,expected %v , got  %v", i, c.expect, resp)
 		}
@@ -168,3 +255,320 @@ func TestFetchMessages(t *testing.T) {
 	}
 
 }
+
+func TestDeleteMessages(t *testing.T) {
+
+	cases := []struct {
+		handles       []string
+		failDelete    map[string]bool
+		expectDeleted []string
+		expectErrors  int
+	}{
+		{
+			handles:       []string{"h1", "h2"},
+			expectDeleted: []string{"h1", "h2"},
+		},
+		{
+			handles:       []string{"h1", "h2"},
+			failDelete:    map[string]bool{"h2": true},
+			expectDeleted: []string{"h1"},
+			expectErrors:  1,
+		},
+	}
+
+	for i, c := range cases {
+
+		var messages []*sqs.Message
+		for _, h := range c.handles {
+			messages = append(messages, &sqs.Message{
+				MessageId:     aws.String("id-" + h),
+				ReceiptHandle: aws.String(h),
+				Body:          aws.String(correctSQSMSG),
+			})
+		}
+
+		mock := &mockedReceiveMsgs{
+			msg:        sqs.ReceiveMessageOutput{Messages: messages},
+			failDelete: c.failDelete,
+		}
+		sqsReader := sqsStage{
+			sqsQueue: sqsQueue{
+				client: mock,
+			},
+			cnf: SQSConfig{
+				DeleteInterval: 10 * time.Millisecond,
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		resultCh := sqsReader.ReadMessages(ctx)
+
+		notifications, errCount := 0, 0
+		for notifications < len(c.handles) || errCount < c.expectErrors {
+			select {
+			case s3Notif := <-resultCh:
+				if s3Notif.GetError() != nil {
+					errCount++
+					continue
+				}
+				notifications++
+				s3Notif.GetAck().Ack()
+			case <-time.After(1 * time.Second):
+				t.Fatalf("case (%d) test timedout", i)
+			}
+		}
+
+		deadline := time.After(1 * time.Second)
+		for len(mock.deletedHandles()) < len(c.expectDeleted) {
+			select {
+			case <-deadline:
+				t.Fatalf("case (%d) test timedout waiting for deletions", i)
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+
+		cancel()
+		for range resultCh {
+		}
+
+		if !reflect.DeepEqual(mock.deletedHandles(), c.expectDeleted) {
+			t.Fatalf("case (%d) expecting deleted %v got %v", i, c.expectDeleted, mock.deletedHandles())
+		}
+	}
+
+}
+
+func TestInflightLimiter(t *testing.T) {
+
+	limiter := newInflightLimiter(3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if n := limiter.reserve(ctx, 10); n != 3 {
+		t.Fatalf("expecting 3 reserved slots got %d", n)
+	}
+
+	reserved := make(chan int)
+	go func() {
+		reserved <- limiter.reserve(ctx, 10)
+	}()
+
+	select {
+	case n := <-reserved:
+		t.Fatalf("reserved %d slots while the limiter is full", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	limiter.release(2)
+	select {
+	case n := <-reserved:
+		if n != 2 {
+			t.Fatalf("expecting 2 reserved slots got %d", n)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+
+	cancel()
+	if n := limiter.reserve(ctx, 10); n != 0 {
+		t.Fatalf("expecting no slot after cancel got %d", n)
+	}
+}
+
+func TestVisibilityHeartbeat(t *testing.T) {
+
+	mock := &mockedReceiveMsgs{
+		msg: sqs.ReceiveMessageOutput{
+			Messages: []*sqs.Message{
+				{
+					MessageId:     aws.String("id-h1"),
+					ReceiptHandle: aws.String("h1"),
+					Body:          aws.String(correctSQSMSG),
+				},
+			},
+		},
+	}
+	sqsReader := sqsStage{
+		sqsQueue: sqsQueue{
+			client: mock,
+		},
+		cnf: SQSConfig{
+			VisibilityTimeout:     60,
+			HeartbeatInterval:     10 * time.Millisecond,
+			NackVisibilityTimeout: 5,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var s3Notif S3Notification
+	select {
+	case s3Notif = <-sqsReader.ReadMessages(ctx):
+	case <-time.After(1 * time.Second):
+		t.Fatalf("test timedout")
+	}
+
+	deadline := time.After(1 * time.Second)
+	for len(mock.visibilityChanges()) < 2 {
+		select {
+		case <-deadline:
+			t.Fatalf("test timedout waiting for extensions")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	s3Notif.GetAck().Nack(fmt.Errorf("failed"))
+
+	for {
+		changes := mock.visibilityChanges()
+		if last := changes[len(changes)-1]; last == 5 {
+			for _, v := range changes[:len(changes)-1] {
+				if v != 60 {
+					t.Fatalf("expecting extensions to 60 got %v", changes)
+				}
+			}
+			break
+		}
+
+		select {
+		case <-deadline:
+			t.Fatalf("test timedout waiting for the nack visibility, got %v", changes)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if changes := mock.visibilityChanges(); changes[len(changes)-1] != 5 {
+		t.Fatalf("expecting no extension after nack got %v", changes)
+	}
+}
+
+func TestFetchMessagesParseError(t *testing.T) {
+
+	q := &sqsQueue{
+		client: &mockedReceiveMsgs{
+			msg: sqs.ReceiveMessageOutput{
+				Messages: []*sqs.Message{
+					{MessageId: aws.String("bad"), Body: aws.String("not json")},
+					{MessageId: aws.String("good"), Body: aws.String(correctSQSMSG)},
+				},
+			},
+		},
+	}
+
+	messages, err := q.fetchMessages(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("expecting 2 messages got %d", len(messages))
+	}
+
+	var appErr *AppError
+	if !errors.As(messages[0].err, &appErr) {
+		t.Fatalf("expecting an AppError got %v", messages[0].err)
+	}
+	if appErr.Misc["messageId"] != "bad" || appErr.Misc["body"] != "not json" {
+		t.Fatalf("expecting the message id and body in the error got %v", appErr.Misc)
+	}
+
+	if messages[1].err != nil || len(messages[1].records) != 1 {
+		t.Fatalf("expecting the good message to be parsed got %v", messages[1])
+	}
+}
+
+func TestRejectPoisonMessage(t *testing.T) {
+
+	cases := []struct {
+		maxReceiveCount int
+		receiveCount    string
+		deadLetterQueue string
+		expectDeleted   []string
+		expectSent      []string
+	}{
+		{
+			maxReceiveCount: 3,
+			receiveCount:    "1",
+		},
+		{
+			maxReceiveCount: 3,
+			receiveCount:    "3",
+			expectDeleted:   []string{"h1"},
+		},
+		{
+			maxReceiveCount: 3,
+			receiveCount:    "3",
+			deadLetterQueue: "dlq",
+			expectDeleted:   []string{"h1"},
+			expectSent:      []string{"dlq"},
+		},
+		// the default policy drops a message on its 5th receive
+		{
+			receiveCount: "4",
+		},
+		{
+			receiveCount:  "5",
+			expectDeleted: []string{"h1"},
+		},
+		{
+			maxReceiveCount: -1,
+			receiveCount:    "100",
+		},
+	}
+
+	for i, c := range cases {
+		mock := &mockedReceiveMsgs{
+			msg: sqs.ReceiveMessageOutput{
+				Messages: []*sqs.Message{
+					{
+						MessageId:     aws.String("id-h1"),
+						ReceiptHandle: aws.String("h1"),
+						Body:          aws.String("not json"),
+						Attributes: map[string]*string{
+							sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(c.receiveCount),
+						},
+					},
+				},
+			},
+		}
+		sqsReader := sqsStage{
+			sqsQueue: sqsQueue{
+				client: mock,
+			},
+			cnf: SQSConfig{
+				DeleteInterval:     10 * time.Millisecond,
+				MaxReceiveCount:    c.maxReceiveCount,
+				DeadLetterQueueURL: c.deadLetterQueue,
+			},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		resultCh := sqsReader.ReadMessages(ctx)
+
+		select {
+		case s3Notif := <-resultCh:
+			if s3Notif.GetError() == nil {
+				t.Fatalf("case (%d) expecting a parse error", i)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("case (%d) test timedout", i)
+		}
+
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+		for range resultCh {
+		}
+
+		if !reflect.DeepEqual(mock.deletedHandles(), c.expectDeleted) {
+			t.Fatalf("case (%d) expecting deleted %v got %v", i, c.expectDeleted, mock.deletedHandles())
+		}
+		if !reflect.DeepEqual(mock.sent, c.expectSent) {
+			t.Fatalf("case (%d) expecting sent to %v got %v", i, c.expectSent, mock.sent)
+		}
+		if c.expectDeleted == nil && len(mock.visibilityChanges()) != 1 {
+			t.Fatalf("case (%d) expecting the message to be made visible got %v", i, mock.visibilityChanges())
+		}
+	}
+}
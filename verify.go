@@ -0,0 +1,237 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// sidecarHashes are the digests a sidecar file can hold, by extension.
+var sidecarHashes = map[string]func() hash.Hash{
+	".sha256": sha256.New,
+	".sha1":   sha1.New,
+	".md5":    md5.New,
+}
+
+type digest struct {
+	name string
+	want []byte
+	hash hash.Hash
+}
+
+// verifier hashes the content of an object and compares it to the digests
+// S3 or a sidecar file hold for it.
+type verifier struct {
+	key     string
+	digests []*digest
+}
+
+func (v *verifier) add(name string, want []byte, h hash.Hash) {
+	v.digests = append(v.digests, &digest{name: name, want: want, hash: h})
+}
+
+// addETag expects the ETag to be the MD5 of the content, which only holds
+// for single part uploads that are not encrypted with KMS or customer keys.
+func (v *verifier) addETag(etag, sse, sseCustomer string) {
+	etag = strings.Trim(etag, `"`)
+	if strings.Contains(etag, "-") || sse == s3.ServerSideEncryptionAwsKms || sseCustomer != "" {
+		return
+	}
+	if want, err := hex.DecodeString(etag); err == nil && len(want) == md5.Size {
+		v.add("etag-md5", want, md5.New())
+	}
+}
+
+// addChecksum adds a base64 S3 additional checksum. The checksums of
+// multipart uploads are checksums of the part checksums and are skipped.
+func (v *verifier) addChecksum(name string, checksum *string, h hash.Hash) {
+	value := aws.StringValue(checksum)
+	if value == "" || strings.Contains(value, "-") {
+		return
+	}
+	if want, err := base64.StdEncoding.DecodeString(value); err == nil {
+		v.add(name, want, h)
+	}
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	for _, d := range v.digests {
+		d.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+// check returns an AppError naming the first digest the content written
+// so far does not match.
+func (v *verifier) check() error {
+	for _, d := range v.digests {
+		if got := d.hash.Sum(nil); string(got) != string(d.want) {
+			appErr := wrapError(fmt.Errorf("verify: %v checksum mismatch for %v", d.name, v.key))
+			appErr.Misc["key"] = v.key
+			appErr.Misc["checksum"] = d.name
+			appErr.Misc["expected"] = hex.EncodeToString(d.want)
+			appErr.Misc["actual"] = hex.EncodeToString(got)
+			return appErr
+		}
+	}
+	return nil
+}
+
+// objectHeaders are the headers of a HeadObject response a verifier reads.
+type objectHeaders struct {
+	etag        *string
+	sse         *string
+	sseCustomer *string
+	sha256      *string
+	sha1        *string
+	crc32       *string
+	crc32c      *string
+}
+
+// verifier returns a verifier for the object from its headers, unless h is
+// nil, and its sidecar file, when sidecar is set. It returns nil when there
+// is nothing to verify.
+func (s *s3Client) verifier(ctx context.Context, bucket, key string, h *objectHeaders, sidecar string) (*verifier, error) {
+
+	v := &verifier{key: key}
+	if h != nil {
+		v.addETag(aws.StringValue(h.etag), aws.StringValue(h.sse), aws.StringValue(h.sseCustomer))
+		v.addChecksum("sha256", h.sha256, sha256.New())
+		v.addChecksum("sha1", h.sha1, sha1.New())
+		v.addChecksum("crc32", h.crc32, crc32.NewIEEE())
+		v.addChecksum("crc32c", h.crc32c, crc32.New(crc32.MakeTable(crc32.Castagnoli)))
+	}
+
+	if err := s.addSidecar(ctx, v, bucket, key+sidecar, sidecar); err != nil {
+		return nil, err
+	}
+
+	if len(v.digests) == 0 {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// objectHeaders returns the headers of the object version of meta,
+// additional checksums included. Without a version id the ETag pins the
+// object, the headers of an object overwritten since are not returned.
+func (s *s3Client) objectHeaders(ctx context.Context, meta ObjectMeta) (*objectHeaders, error) {
+
+	input := &s3.HeadObjectInput{
+		Bucket:       aws.String(meta.Bucket),
+		Key:          aws.String(meta.Key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}
+	if meta.VersionID != "" {
+		input.VersionId = aws.String(meta.VersionID)
+	} else if meta.ETag != "" {
+		input.IfMatch = aws.String(meta.ETag)
+	}
+
+	out, err := s.api.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, downloadError(meta.Key, err)
+	}
+
+	return &objectHeaders{
+		etag:        out.ETag,
+		sse:         out.ServerSideEncryption,
+		sseCustomer: out.SSECustomerAlgorithm,
+		sha256:      out.ChecksumSHA256,
+		sha1:        out.ChecksumSHA1,
+		crc32:       out.ChecksumCRC32,
+		crc32c:      out.ChecksumCRC32C,
+	}, nil
+}
+
+// addSidecar adds the digest of a sidecar file in the sha256sum format,
+// "<hex digest>  <file name>". A missing sidecar file fails the object, it
+// is usually uploaded after the object and found once the notification of
+// the object is redelivered.
+func (s *s3Client) addSidecar(ctx context.Context, v *verifier, bucket, sidecarKey, ext string) error {
+
+	if ext == "" {
+		return nil
+	}
+	newHash, ok := sidecarHashes[strings.ToLower(path.Ext(ext))]
+	if !ok {
+		return wrapError(fmt.Errorf("verify: unsupported sidecar extension %v", ext))
+	}
+
+	out, err := s.api.GetObjectWithContext(ctx, objectInput(bucket, sidecarKey, ""))
+	if err != nil {
+		var s3Error awserr.Error
+		if errors.As(err, &s3Error) && s3Error.Code() == s3.ErrCodeNoSuchKey {
+			return wrapError(fmt.Errorf("verify: sidecar file %v not found %w", sidecarKey, err))
+		}
+		return downloadError(sidecarKey, err)
+	}
+	defer out.Body.Close()
+
+	line, err := bufio.NewReader(io.LimitReader(out.Body, 1024)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return downloadError(sidecarKey, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return wrapError(fmt.Errorf("verify: empty sidecar file %v", sidecarKey))
+	}
+	want, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return wrapError(fmt.Errorf("verify: invalid sidecar file %v %w", sidecarKey, err))
+	}
+
+	v.add("sidecar"+ext, want, newHash())
+	return nil
+}
+
+// verifyDownload checks a downloaded object against the checksums of the
+// configuration, before any of its rows is read.
+func (stg s3Stage) verifyDownload(ctx context.Context, client *s3Client, meta ObjectMeta, f io.ReadSeeker) error {
+
+	if !stg.cnf.Verify && stg.cnf.Sidecar == "" {
+		return nil
+	}
+
+	var h *objectHeaders
+	if stg.cnf.Verify {
+		var err error
+		if h, err = client.objectHeaders(ctx, meta); err != nil {
+			return err
+		}
+	}
+
+	v, err := client.verifier(ctx, meta.Bucket, meta.Key, h, stg.cnf.Sidecar)
+	if err != nil || v == nil {
+		return err
+	}
+
+	return verifyFile(f, v)
+}
+
+// verifyFile hashes f from its start and rewinds it.
+func verifyFile(f io.ReadSeeker, v *verifier) error {
+
+	if _, err := io.Copy(v, f); err != nil {
+		return fmt.Errorf("verify: failed to read %v %w", v.key, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("verify: failed to rewind %v %w", v.key, err)
+	}
+	return v.check()
+}
@@ -0,0 +1,283 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestVerify(t *testing.T) {
+
+	original := "a,b\n1,2\n"
+	corrupt := "a,b\n1,3\n"
+	md5Sum := md5.Sum([]byte(original))
+	sha256Sum := sha256.Sum256([]byte(original))
+	etag := `"` + hex.EncodeToString(md5Sum[:]) + `"`
+	sidecar := hex.EncodeToString(sha256Sum[:]) + "  a.csv\n"
+
+	cases := []struct {
+		stream       bool
+		served       string
+		cnf          S3Config
+		etag         string
+		sha256       string
+		sidecar      string
+		expectFailed string
+		expectErr    string
+	}{
+		{
+			stream: true,
+			served: original,
+			cnf:    S3Config{Verify: true},
+			etag:   etag,
+			sha256: base64.StdEncoding.EncodeToString(sha256Sum[:]),
+		},
+		{
+			// a streamed object is downloaded to be checked first
+			stream:       true,
+			served:       corrupt,
+			cnf:          S3Config{Verify: true},
+			etag:         etag,
+			expectFailed: "etag-md5",
+		},
+		{
+			// the etag of a multipart upload is not an MD5
+			served:       corrupt,
+			cnf:          S3Config{Verify: true},
+			etag:         `"0123456789abcdef-2"`,
+			sha256:       base64.StdEncoding.EncodeToString(sha256Sum[:]),
+			expectFailed: "sha256",
+		},
+		{
+			served: corrupt,
+			cnf:    S3Config{},
+			etag:   etag,
+		},
+		{
+			served:       corrupt,
+			cnf:          S3Config{Sidecar: ".sha256"},
+			sidecar:      sidecar,
+			expectFailed: "sidecar.sha256",
+		},
+		{
+			stream:       true,
+			served:       corrupt,
+			cnf:          S3Config{Sidecar: ".sha256"},
+			sidecar:      sidecar,
+			expectFailed: "sidecar.sha256",
+		},
+		{
+			served:  original,
+			cnf:     S3Config{Verify: true, Sidecar: ".sha256"},
+			etag:    etag,
+			sidecar: sidecar,
+		},
+		{
+			// a missing sidecar file fails the object until it is uploaded
+			served:    original,
+			cnf:       S3Config{Sidecar: ".sha256"},
+			expectErr: "sidecar file a.csv.sha256 not found",
+		},
+	}
+
+	for i, c := range cases {
+		api := s3APIMock{
+			objects: map[string]string{"a.csv": c.served},
+			etags:   map[string]string{},
+			sha256s: map[string]string{},
+		}
+		if c.etag != "" {
+			api.etags["a.csv"] = c.etag
+		}
+		if c.sha256 != "" {
+			api.sha256s["a.csv"] = c.sha256
+		}
+		if c.sidecar != "" {
+			api.objects["a.csv"+c.cnf.Sidecar] = c.sidecar
+		}
+
+		c.cnf.Stream = c.stream
+		c.cnf.SpillDir = t.TempDir()
+		c.cnf.Retry = RetryPolicy{MaxAttempts: 1}
+		stg := s3Stage{
+			client: s3Client{
+				api:        api,
+				downloader: downloaderMock{fileText: c.served},
+			},
+			cnf: c.cnf,
+		}
+
+		var content []byte
+		file, err := stg.open(context.Background(), &stg.client, ObjectMeta{Bucket: "bucket", Key: "a.csv"})
+		if err == nil {
+			if c.expectFailed != "" || c.expectErr != "" {
+				file.Close()
+				t.Fatalf("case (%d) expecting the open to fail", i)
+			}
+			content, err = io.ReadAll(file)
+			file.Close()
+		}
+
+		if c.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.expectErr) {
+				t.Fatalf("case (%d) expecting error %q got %v", i, c.expectErr, err)
+			}
+			continue
+		}
+		if c.expectFailed == "" {
+			if err != nil {
+				t.Fatalf("case (%d) unexpected error %v", i, err)
+			}
+			if string(content) != c.served {
+				t.Fatalf("case (%d) expecting %q got %q", i, c.served, content)
+			}
+			continue
+		}
+
+		var appErr *AppError
+		if !errors.As(err, &appErr) {
+			t.Fatalf("case (%d) expecting an AppError got %v", i, err)
+		}
+		if appErr.Misc["checksum"] != c.expectFailed || appErr.Misc["key"] != "a.csv" {
+			t.Fatalf("case (%d) expecting a %v mismatch got %v", i, c.expectFailed, appErr.Misc)
+		}
+	}
+}
+
+// headMock records the HeadObject requests.
+type headMock struct {
+	s3APIMock
+	heads []*s3.HeadObjectInput
+}
+
+func (m *headMock) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	m.heads = append(m.heads, in)
+	return m.s3APIMock.HeadObjectWithContext(ctx, in, opts...)
+}
+
+func TestVerifyPinned(t *testing.T) {
+
+	cases := []struct {
+		meta          ObjectMeta
+		expectVersion string
+		expectIfMatch string
+	}{
+		{
+			meta:          ObjectMeta{Bucket: "bucket", Key: "a.csv", VersionID: "v1", ETag: "e1"},
+			expectVersion: "v1",
+		},
+		{
+			meta:          ObjectMeta{Bucket: "bucket", Key: "a.csv", ETag: "e1"},
+			expectIfMatch: "e1",
+		},
+		{
+			meta: ObjectMeta{Bucket: "bucket", Key: "a.csv"},
+		},
+	}
+
+	for i, c := range cases {
+		api := &headMock{s3APIMock: s3APIMock{objects: map[string]string{"a.csv": "a\n"}}}
+		stg := s3Stage{
+			client: s3Client{
+				api:        api,
+				downloader: downloaderMock{fileText: "a\n", versionID: c.meta.VersionID},
+			},
+			cnf: S3Config{Verify: true, SpillDir: t.TempDir(), Retry: RetryPolicy{MaxAttempts: 1}},
+		}
+
+		file, err := stg.open(context.Background(), &stg.client, c.meta)
+		if err != nil {
+			t.Fatalf("case (%d) unexpected error %v", i, err)
+		}
+		file.Close()
+
+		if len(api.heads) != 1 {
+			t.Fatalf("case (%d) expecting one HeadObject got %d", i, len(api.heads))
+		}
+		head := api.heads[0]
+		if aws.StringValue(head.VersionId) != c.expectVersion || aws.StringValue(head.IfMatch) != c.expectIfMatch {
+			t.Fatalf("case (%d) expecting version %q if-match %q got %q %q", i, c.expectVersion, c.expectIfMatch, aws.StringValue(head.VersionId), aws.StringValue(head.IfMatch))
+		}
+	}
+}
+
+func TestFetchSidecar(t *testing.T) {
+
+	content := "a,b\n1,2\n"
+	sum := sha256.Sum256([]byte(content))
+	objects := map[string]string{
+		"a.csv":        content,
+		"a.csv.sha256": hex.EncodeToString(sum[:]) + "  a.csv\n",
+		"b.csv":        content,
+	}
+	stg := s3Stage{
+		client: s3Client{
+			api:        s3APIMock{objects: objects},
+			downloader: downloaderMock{fileText: content},
+		},
+		cnf: S3Config{
+			Sidecar:  ".sha256",
+			SpillDir: t.TempDir(),
+			Retry:    RetryPolicy{MaxAttempts: 1},
+		},
+	}
+
+	keys := []string{"a.csv.sha256", "a.csv", "b.csv"}
+	resolved := make([]chan error, len(keys))
+	notificationCh := make(chan S3Notification, len(keys))
+	for i, key := range keys {
+		resolved[i] = make(chan error, 1)
+		done := resolved[i]
+		notificationCh <- &SQSS3Event{
+			message: Record{
+				S3Data: S3{
+					Bucket: Bucket{Name: "bucket"},
+					Object: Object{Key: key},
+				},
+			},
+			ack: NewAcker(func() { done <- nil }, func(err error) { done <- err }),
+		}
+	}
+	close(notificationCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	var names []string
+	for file := range stg.Fetch(ctx, notificationCh) {
+		if file.GetError() != nil {
+			continue
+		}
+		names = append(names, file.FileName())
+		file.File().Close()
+		file.GetAck().Ack()
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("test timedout")
+	}
+
+	// the sidecar file is skipped and b.csv waits for its own
+	if len(names) != 1 || names[0] != "a.csv" {
+		t.Fatalf("expecting a.csv only got %v", names)
+	}
+	for i, expectNack := range []bool{false, false, true} {
+		select {
+		case err := <-resolved[i]:
+			if expectNack != (err != nil) {
+				t.Fatalf("case (%d) expecting nack %v got %v", i, expectNack, err)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("case (%d) test timedout", i)
+		}
+	}
+}